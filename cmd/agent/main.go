@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/InsafMin/web_calculator/internal/agent/worker"
+	"github.com/InsafMin/web_calculator/pkg/calculator"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -15,17 +22,69 @@ func main() {
 	}
 
 	computingPower, err := strconv.Atoi(computingPowerStr)
-	if err != nil {
-		log.Fatalf("Invalid COMPUTING_POWER value: %v", err)
+	if err != nil || computingPower < 1 {
+		log.Fatalf("Invalid COMPUTING_POWER value: %q", computingPowerStr)
+	}
+
+	shutdownTimeout := 10 * time.Second
+	if ms, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT_MS")); err == nil {
+		shutdownTimeout = time.Duration(ms) * time.Millisecond
 	}
 
+	var transport worker.Transport
+	if os.Getenv("TRANSPORT") == "grpc" {
+		addr := os.Getenv("ORCHESTRATOR_GRPC_ADDR")
+		if addr == "" {
+			addr = "localhost:9090"
+		}
+		transport, err = worker.NewGRPCTransport(addr)
+		if err != nil {
+			log.Fatalf("Could not create gRPC transport: %v", err)
+		}
+	} else {
+		orchestratorURL := os.Getenv("ORCHESTRATOR_URL")
+		if orchestratorURL == "" {
+			orchestratorURL = "http://localhost:8080"
+		}
+		transport = worker.NewHTTPTransport(orchestratorURL)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	log.Println("Waiting for orchestrator to start...")
-	time.Sleep(5 * time.Second)
+	select {
+	case <-time.After(5 * time.Second):
+	case <-ctx.Done():
+		return
+	}
 
-	for i := 0; i < computingPower; i++ {
-		go worker.StartWorker()
+	agent := worker.Registration{
+		ID:         agentID(),
+		Capacity:   computingPower,
+		Operations: calculator.Operations(),
 	}
+	if ops := os.Getenv("AGENT_OPERATIONS"); ops != "" {
+		agent.Operations = strings.Split(ops, ",")
+	}
+
+	log.Println("Agent", agent.ID, "started with", computingPower, "workers")
+	worker.NewPool(transport, agent, shutdownTimeout).Run(ctx)
+	log.Println("Agent stopped")
+}
 
-	log.Println("Agent started with", computingPower, "workers")
-	select {}
+// agentID берёт идентификатор агента из AGENT_ID или строит его из имени хоста
+// и случайного суффикса, чтобы перезапущенный агент не путался с прежним.
+func agentID() string {
+	if id := os.Getenv("AGENT_ID"); id != "" {
+		return id
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "agent"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
 }
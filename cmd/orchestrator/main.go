@@ -2,18 +2,49 @@ package main
 
 import (
 	"github.com/InsafMin/web_calculator/internal/orchestrator/handlers"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/storage"
+	"google.golang.org/grpc"
 	"log"
+	"net"
 	"net/http"
+	"os"
 )
 
 func main() {
-	http.HandleFunc("/api/v1/calculate", handlers.HandleCalculate)
-	http.HandleFunc("/api/v1/expressions", handlers.HandleGetExpressions)
-	http.HandleFunc("/api/v1/expressions/", handlers.HandleGetExpression)
-	http.HandleFunc("/internal/task", handlers.HandleTask)
+	path := os.Getenv("STORAGE_PATH")
+	if path == "" {
+		path = "data/calculator.db"
+	}
+	store, err := storage.Open(os.Getenv("STORAGE"), path)
+	if err != nil {
+		log.Fatalf("Could not open storage: %v", err)
+	}
+	defer store.Close()
+
+	orchestrator, err := handlers.NewOrchestrator(store, handlers.ConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Could not restore state: %v", err)
+	}
+
+	grpcAddr := os.Getenv("GRPC_ADDR")
+	if grpcAddr == "" {
+		grpcAddr = ":9090"
+	}
+	listener, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		log.Fatalf("Could not listen on %s: %v", grpcAddr, err)
+	}
+	grpcServer := grpc.NewServer()
+	orchestrator.RegisterGRPC(grpcServer)
+	go func() {
+		log.Println("Starting gRPC server on", grpcAddr)
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Fatalf("Could not start gRPC server: %v", err)
+		}
+	}()
 
 	log.Println("Starting orchestrator on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := http.ListenAndServe(":8080", orchestrator.Handler()); err != nil {
 		log.Fatalf("Could not start server: %v", err)
 	}
 }
@@ -0,0 +1,212 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/workerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"log"
+	"sync"
+	"time"
+)
+
+// grpcTransport получает задачи от оркестратора по потоку Work вместо опроса:
+// каждый ждущий вычислитель объявляет свободное место, и оркестратор сразу
+// присылает на него задачу. Поток общий для всех вычислителей агента и при
+// обрыве открывается заново.
+type grpcTransport struct {
+	client workerpb.WorkerClient
+	tasks  chan *Task
+
+	mutex   sync.Mutex
+	stream  workerpb.Worker_WorkClient
+	agent   *Registration
+	waiting int
+	closed  bool
+}
+
+func NewGRPCTransport(addr string) (Transport, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to orchestrator: %w", err)
+	}
+	return &grpcTransport{client: workerpb.NewWorkerClient(conn), tasks: make(chan *Task)}, nil
+}
+
+func (t *grpcTransport) connect(ctx context.Context, stop <-chan struct{}, abort func(taskIDs []string)) {
+	for ctx.Err() == nil && !t.isClosed() {
+		if err := t.runStream(ctx, stop, abort); err != nil && ctx.Err() == nil && !t.isClosed() {
+			log.Printf("Work stream closed: %v\n", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// close закрывает поток со стороны агента. Оркестратор обрабатывает уже
+// отправленные ответы и завершает поток, после чего connect возвращается.
+func (t *grpcTransport) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+	if t.stream != nil {
+		t.stream.CloseSend()
+	}
+}
+
+func (t *grpcTransport) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
+
+func (t *grpcTransport) runStream(ctx context.Context, stop <-chan struct{}, abort func(taskIDs []string)) error {
+	stream, err := t.client.Work(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Регистрация и места, объявленные в прежнем потоке, пропали вместе с
+	// ним: повторяем регистрацию и объявляем всех, кто сейчас ждёт задачу.
+	t.mutex.Lock()
+	t.stream = stream
+	err = t.sendRegister()
+	if err == nil {
+		err = t.sendReady(t.waiting)
+	}
+	t.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		t.mutex.Lock()
+		t.stream = nil
+		t.mutex.Unlock()
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch payload := msg.Payload.(type) {
+		case *workerpb.OrchestratorMessage_Task:
+			task := fromProtoTask(payload.Task)
+			select {
+			case t.tasks <- task:
+			case <-stop:
+				// Ждавший её вычислитель уже остановился.
+				t.report(ctx, taskResult{ID: task.ID, LeaseID: task.LeaseID, Release: true})
+			}
+		case *workerpb.OrchestratorMessage_Cancel:
+			abort(payload.Cancel.TaskIds)
+		case *workerpb.OrchestratorMessage_Ack:
+			if ack := payload.Ack; ack.Code != "" {
+				fmt.Printf("Result for task %s rejected: %s\n", ack.Id, ack.Message)
+			}
+		}
+	}
+}
+
+// register запоминает описание агента и отправляет его в открытый поток;
+// при каждом переподключении оно отправляется заново.
+func (t *grpcTransport) register(ctx context.Context, agent Registration) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.agent = &agent
+	return t.sendRegister()
+}
+
+// heartbeat не возвращает задач для прерывания: они приходят по потоку сразу.
+func (t *grpcTransport) heartbeat(ctx context.Context) ([]string, error) {
+	return nil, t.send(&workerpb.AgentMessage{Payload: &workerpb.AgentMessage_Heartbeat{Heartbeat: &workerpb.Heartbeat{}}})
+}
+
+// sendRegister вызывается под mutex.
+func (t *grpcTransport) sendRegister() error {
+	if t.stream == nil || t.agent == nil {
+		return nil
+	}
+	return t.stream.Send(&workerpb.AgentMessage{
+		Payload: &workerpb.AgentMessage_Register{Register: &workerpb.Register{
+			AgentId:    t.agent.ID,
+			Capacity:   int32(t.agent.Capacity),
+			Operations: t.agent.Operations,
+		}},
+	})
+}
+
+// sendReady вызывается под mutex.
+func (t *grpcTransport) sendReady(slots int) error {
+	if t.stream == nil || slots == 0 {
+		return nil
+	}
+	return t.stream.Send(&workerpb.AgentMessage{
+		Payload: &workerpb.AgentMessage_Ready{Ready: &workerpb.Ready{Slots: int32(slots)}},
+	})
+}
+
+func (t *grpcTransport) fetch(ctx context.Context) (*Task, error) {
+	t.mutex.Lock()
+	t.waiting++
+	// Ошибку отправки не возвращаем: при переподключении место объявится заново.
+	t.sendReady(1)
+	t.mutex.Unlock()
+
+	defer func() {
+		t.mutex.Lock()
+		t.waiting--
+		t.mutex.Unlock()
+	}()
+
+	select {
+	case task := <-t.tasks:
+		return task, nil
+	case <-ctx.Done():
+		// Снимаем место, иначе оркестратор пришлёт на него задачу, которую
+		// придётся вернуть.
+		t.mutex.Lock()
+		t.sendReady(-1)
+		t.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (t *grpcTransport) report(ctx context.Context, result taskResult) error {
+	return t.send(&workerpb.AgentMessage{
+		Payload: &workerpb.AgentMessage_Result{Result: &workerpb.TaskResult{
+			Id:      result.ID,
+			LeaseId: result.LeaseID,
+			Result:  result.Result,
+			Error:   result.Error,
+			Release: result.Release,
+		}},
+	})
+}
+
+func (t *grpcTransport) send(msg *workerpb.AgentMessage) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.stream == nil {
+		return fmt.Errorf("work stream is not connected")
+	}
+	return t.stream.Send(msg)
+}
+
+func fromProtoTask(task *workerpb.Task) *Task {
+	return &Task{
+		ID:            task.Id,
+		Arg1:          task.Arg1,
+		Arg2:          task.Arg2,
+		Args:          task.Args,
+		Operation:     task.Operation,
+		OperationTime: task.OperationTime.AsDuration(),
+		ExpressionID:  task.ExpressionId,
+		Priority:      int(task.Priority),
+		LeaseID:       task.LeaseId,
+	}
+}
@@ -1,6 +1,8 @@
 package worker
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/InsafMin/web_calculator/pkg/calculator"
@@ -8,8 +10,7 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"strings"
+	"net/url"
 	"sync"
 	"time"
 )
@@ -18,74 +19,373 @@ type Task struct {
 	ID            string        `json:"id"`
 	Arg1          float64       `json:"arg1"`
 	Arg2          float64       `json:"arg2"`
+	Args          []float64     `json:"args,omitempty"`
 	Operation     string        `json:"operation"`
 	OperationTime time.Duration `json:"operation_time"`
 	ExpressionID  string        `json:"expression_id"`
 	Priority      int           `json:"priority"`
+	LeaseID       string        `json:"lease_id"`
 	Done          chan bool     `json:"-"`
 }
 
-var (
-	globalMutex sync.Mutex
-)
+// taskResult — ответ агента по задаче: результат, причина, по которой
+// задачу выполнить не удалось, или отказ от неё.
+type taskResult struct {
+	ID      string  `json:"id"`
+	LeaseID string  `json:"lease_id"`
+	Result  float64 `json:"result"`
+	Error   string  `json:"error,omitempty"`
+	Release bool    `json:"release,omitempty"`
+}
+
+// Registration — описание агента, с которым он регистрируется в оркестраторе.
+type Registration struct {
+	ID         string   `json:"id"`
+	Capacity   int      `json:"capacity"`
+	Operations []string `json:"operations"`
+}
+
+// heartbeatInterval — как часто агент сообщает, что жив. Оркестратор
+// исключает агента после AGENT_TIMEOUT_MS без сигналов (по умолчанию 15 секунд).
+const heartbeatInterval = 5 * time.Second
+
+// Transport — способ получать задачи от оркестратора и отправлять ответы.
+type Transport interface {
+	register(ctx context.Context, agent Registration) error
+	// heartbeat возвращает задачи, которые оркестратор просит прервать, или
+	// errors.ErrAgentNotFound, если оркестратор уже исключил агента и его
+	// нужно зарегистрировать заново.
+	heartbeat(ctx context.Context) ([]string, error)
+	// connect держит соединение с оркестратором, пока не вызван close или
+	// не отменён ctx; после закрытия stop новые задачи агенту уже не нужны.
+	// Просьбы прервать задачи, пришедшие по соединению, передаются в abort.
+	connect(ctx context.Context, stop <-chan struct{}, abort func(taskIDs []string))
+	// close завершает соединение, дав оркестратору принять отправленные ответы.
+	close()
+	// fetch ждёт следующую задачу, пока не отменён ctx.
+	fetch(ctx context.Context) (*Task, error)
+	report(ctx context.Context, result taskResult) error
+}
 
-func StartWorker() {
+// Pool — ограниченный пул вычислителей агента. Вычислители работают
+// независимо друг от друга: каждый сам получает задачу, выполняет её и
+// отправляет результат.
+type Pool struct {
+	transport       Transport
+	agent           Registration
+	shutdownTimeout time.Duration
+	// heartbeatInterval — пауза между сигналами; в тестах её сокращают.
+	heartbeatInterval time.Duration
+	// reregister просит зарегистрироваться заново, не дожидаясь сигнала.
+	reregister chan struct{}
+	running    *runningTasks
+}
+
+// NewPool создаёт пул из agent.Capacity вычислителей. После остановки пул
+// ждёт выполняющиеся задачи не дольше shutdownTimeout, а не успевшие
+// возвращает оркестратору.
+func NewPool(transport Transport, agent Registration, shutdownTimeout time.Duration) *Pool {
+	return &Pool{
+		transport:         transport,
+		agent:             agent,
+		shutdownTimeout:   shutdownTimeout,
+		heartbeatInterval: heartbeatInterval,
+		reregister:        make(chan struct{}, 1),
+		running:           &runningTasks{cancel: make(map[string]context.CancelFunc)},
+	}
+}
+
+// register регистрирует агента, повторяя попытки, пока оркестратор не ответит
+// или не отменён ctx.
+func (p *Pool) register(ctx context.Context) error {
 	for {
-		globalMutex.Lock()
+		err := p.transport.register(ctx, p.agent)
+		if err == nil {
+			log.Printf("Agent %s registered with capacity %d\n", p.agent.ID, p.agent.Capacity)
+			return nil
+		}
+		fmt.Printf("Error registering agent: %v\n", err)
 
-		task, err := fetchTask()
-		if err != nil {
-			if errors.Is(err, errors.ErrNoTasksAvailable) {
-				globalMutex.Unlock()
-				time.Sleep(1 * time.Second)
-				continue
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// keepAlive присылает сигналы до отмены ctx и регистрирует агента заново,
+// если оркестратор успел его исключить.
+func (p *Pool) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(p.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.reregister:
+			p.register(ctx)
+		case <-ticker.C:
+			cancelled, err := p.transport.heartbeat(ctx)
+			p.running.abort(cancelled)
+			if errors.Is(err, errors.ErrAgentNotFound) {
+				p.register(ctx)
+			} else if err != nil {
+				fmt.Printf("Error sending heartbeat: %v\n", err)
 			}
-			fmt.Printf("Error fetching task: %v\n", err)
-			globalMutex.Unlock()
-			continue
 		}
+	}
+}
 
-		result, err := executeTask(task)
-		if err != nil {
-			fmt.Printf("Error executing task %s: %v\n", task.ID, err)
-			globalMutex.Unlock()
-			continue
+// Run запускает вычислители и возвращается, когда после отмены ctx все они
+// завершили или вернули свои задачи.
+func (p *Pool) Run(ctx context.Context) {
+	connCtx, disconnect := context.WithCancel(context.Background())
+	defer disconnect()
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+		p.transport.connect(connCtx, ctx.Done(), p.running.abort)
+	}()
+
+	if err := p.register(ctx); err != nil {
+		return
+	}
+	go p.keepAlive(ctx)
+
+	// Выполнение задач прерывается позже остановки: у начатых задач есть
+	// shutdownTimeout, чтобы завершиться.
+	execCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-finished:
+			return
+		}
+		timer := time.NewTimer(p.shutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			abort()
+		case <-finished:
 		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= p.agent.Capacity; i++ {
+		w := &worker{id: i, transport: p.transport, reregister: p.reregister, running: p.running}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx, execCtx)
+		}()
+	}
+	wg.Wait()
+	close(finished)
+
+	p.transport.close()
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// runningTasks — выполняющиеся задачи пула, которые можно прервать по
+// просьбе оркестратора.
+type runningTasks struct {
+	mutex  sync.Mutex
+	cancel map[string]context.CancelFunc
+}
+
+// start возвращает контекст выполнения задачи и функцию, которую нужно
+// вызвать по её завершении.
+func (r *runningTasks) start(ctx context.Context, taskID string) (context.Context, func()) {
+	taskCtx, cancel := context.WithCancel(ctx)
+
+	r.mutex.Lock()
+	r.cancel[taskID] = cancel
+	r.mutex.Unlock()
+
+	return taskCtx, func() {
+		r.mutex.Lock()
+		delete(r.cancel, taskID)
+		r.mutex.Unlock()
+		cancel()
+	}
+}
 
-		if err := sendResult(task.ID, result); err != nil {
-			fmt.Printf("Error sending result for task %s: %v\n", task.ID, err)
-			globalMutex.Unlock()
+// abort прерывает задачи отменённых выражений; остальные идентификаторы
+// пропускаются.
+func (r *runningTasks) abort(taskIDs []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, id := range taskIDs {
+		if cancel, exists := r.cancel[id]; exists {
+			cancel()
+		}
+	}
+}
+
+// worker — один вычислитель пула и его состояние.
+type worker struct {
+	id         int
+	transport  Transport
+	reregister chan<- struct{}
+	running    *runningTasks
+	completed  int
+}
+
+func (w *worker) run(ctx, execCtx context.Context) {
+	for ctx.Err() == nil {
+		task, err := w.transport.fetch(ctx)
+		if errors.Is(err, errors.ErrAgentNotFound) {
+			select {
+			case w.reregister <- struct{}{}:
+			default:
+			}
+		}
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, errors.ErrNoTasksAvailable) {
+				fmt.Printf("Worker %d: error fetching task: %v\n", w.id, err)
+				time.Sleep(time.Second)
+			}
 			continue
 		}
 
+		w.process(execCtx, task)
+	}
+	log.Printf("Worker %d stopped after %d tasks\n", w.id, w.completed)
+}
+
+// process выполняет задачу и отправляет ответ. Если выполнение прервано
+// остановкой агента, задача возвращается оркестратору; задача отменённого
+// выражения прерывается без ответа.
+func (w *worker) process(execCtx context.Context, task *Task) {
+	reply := taskResult{ID: task.ID, LeaseID: task.LeaseID}
+
+	taskCtx, finish := w.running.start(execCtx, task.ID)
+	result, err := executeTask(taskCtx, task)
+	aborted := taskCtx.Err() != nil
+	finish()
+	switch {
+	case err != nil && execCtx.Err() != nil:
+		log.Printf("Worker %d: handing back task %s\n", w.id, task.ID)
+		reply.Release = true
+	case err != nil && aborted:
+		log.Printf("Worker %d: task %s cancelled by orchestrator\n", w.id, task.ID)
+		return
+	case err != nil:
+		fmt.Printf("Worker %d: error executing task %s: %v\n", w.id, task.ID, err)
+		reply.Error = err.Error()
+	default:
+		reply.Result = result
+	}
+
+	// Ответ отправляется и после остановки: иначе задача зависнет до
+	// истечения аренды.
+	reportCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := w.transport.report(reportCtx, reply); err != nil {
+		fmt.Printf("Worker %d: error sending result for task %s: %v\n", w.id, task.ID, err)
+		return
+	}
+
+	if reply.Error == "" && !reply.Release {
+		w.completed++
 		if task.Done != nil {
 			close(task.Done)
 		}
+		log.Printf("Worker %d: task finished successfully: %+v. Res = %f\n", w.id, task, result)
+	}
+}
 
-		log.Printf("Task finished successfully: %+v. Res = %f\n", task, result)
+func executeTask(ctx context.Context, task *Task) (float64, error) {
+	timer := time.NewTimer(task.OperationTime)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-timer.C:
+	}
 
-		globalMutex.Unlock()
+	args := task.Args
+	if len(args) == 0 {
+		args = []float64{task.Arg1, task.Arg2}
+		if calculator.IsUnary(task.Operation) {
+			args = args[:1]
+		}
 	}
+
+	result, err := calculator.Apply(task.Operation, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// pollWait — сколько оркестратор держит запрос задачи, если очередь пуста.
+const pollWait = 30 * time.Second
+
+// httpTransport опрашивает GET /internal/task с долгим ожиданием и отправляет
+// ответы POST /internal/task.
+type httpTransport struct {
+	orchestratorURL string
+	client          *http.Client
+
+	mutex   sync.Mutex
+	agentID string
+}
+
+func NewHTTPTransport(orchestratorURL string) Transport {
+	return &httpTransport{orchestratorURL: orchestratorURL, client: &http.Client{}}
 }
 
-func fetchTask() (*Task, error) {
-	orchestratorURL := os.Getenv("ORCHESTRATOR_URL")
-	if orchestratorURL == "" {
-		orchestratorURL = "http://localhost:8080"
+func (t *httpTransport) register(ctx context.Context, agent Registration) error {
+	t.mutex.Lock()
+	t.agentID = agent.ID
+	t.mutex.Unlock()
+	return t.post(ctx, "/internal/agents", agent, nil)
+}
+
+func (t *httpTransport) heartbeat(ctx context.Context) ([]string, error) {
+	var response struct {
+		Cancelled []string `json:"cancelled"`
 	}
+	err := t.post(ctx, "/internal/agents/"+url.PathEscape(t.agent())+"/heartbeat", nil, &response)
+	return response.Cancelled, err
+}
+
+func (t *httpTransport) agent() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.agentID
+}
 
-	resp, err := http.Get(orchestratorURL + "/internal/task")
+func (t *httpTransport) connect(ctx context.Context, stop <-chan struct{}, abort func(taskIDs []string)) {
+}
+
+func (t *httpTransport) close() {}
+
+func (t *httpTransport) fetch(ctx context.Context) (*Task, error) {
+	query := url.Values{"wait": {pollWait.String()}, "agent_id": {t.agent()}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.orchestratorURL+"/internal/task?"+query.Encode(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch task: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, errors.ErrNoTasksAvailable
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch task: %w", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, responseError(resp)
 	}
 
 	var response struct {
@@ -98,46 +398,60 @@ func fetchTask() (*Task, error) {
 	return &response.Task, nil
 }
 
-func executeTask(task *Task) (float64, error) {
-	time.Sleep(task.OperationTime)
-
-	result, err := calculator.Resolve(task.Arg1, task.Arg2, task.Operation)
-	if err != nil {
-		return 0, fmt.Errorf("failed to resolve task: %w", err)
-	}
-
-	return result, nil
+func (t *httpTransport) report(ctx context.Context, result taskResult) error {
+	return t.post(ctx, "/internal/task", result, nil)
 }
 
-func sendResult(taskID string, result float64) error {
-	payload := struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result"`
-	}{
-		ID:     taskID,
-		Result: result,
+// post отправляет payload и, если out не nil, разбирает в него ответ.
+func (t *httpTransport) post(ctx context.Context, path string, payload, out any) error {
+	var body io.Reader
+	if payload != nil {
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(jsonData)
 	}
 
-	jsonData, err := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.orchestratorURL+path, body)
 	if err != nil {
-		return fmt.Errorf("failed to marshal result: %w", err)
-	}
-
-	orchestratorURL := os.Getenv("ORCHESTRATOR_URL")
-	if orchestratorURL == "" {
-		orchestratorURL = "http://localhost:8080"
+		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.Post(orchestratorURL+"/internal/task", "application/json", strings.NewReader(string(jsonData)))
+	resp, err := t.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send result: %w", err)
+		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+		return responseError(resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
 	}
 
 	return nil
 }
+
+// responseError превращает ответ оркестратора с ошибкой в ошибку; коды
+// no_tasks_available и agent_not_found становятся ошибками из pkg/errors.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+
+	var response struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(body, &response)
+	switch response.Code {
+	case errors.Code(errors.ErrNoTasksAvailable):
+		return errors.ErrNoTasksAvailable
+	case errors.Code(errors.ErrAgentNotFound):
+		return errors.ErrAgentNotFound
+	}
+
+	return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+}
@@ -0,0 +1,418 @@
+package worker
+
+import (
+	"context"
+	"github.com/InsafMin/web_calculator/internal/workerpb"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport выдаёт задачи из канала и запоминает ответы.
+type fakeTransport struct {
+	tasks   chan *Task
+	reports chan taskResult
+
+	mutex         sync.Mutex
+	registrations int
+	heartbeats    int
+	fetchErr      error
+	heartbeatErr  error
+	inFlight      int
+	maxInFlight   int
+	abort         func(taskIDs []string)
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{tasks: make(chan *Task, 16), reports: make(chan taskResult, 16)}
+}
+
+func (f *fakeTransport) register(ctx context.Context, agent Registration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.registrations++
+	return nil
+}
+
+// heartbeat один раз возвращает heartbeatErr, если она задана.
+func (f *fakeTransport) heartbeat(ctx context.Context) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.heartbeats++
+	err := f.heartbeatErr
+	f.heartbeatErr = nil
+	return nil, err
+}
+
+func (f *fakeTransport) connect(ctx context.Context, stop <-chan struct{}, abort func(taskIDs []string)) {
+	f.mutex.Lock()
+	f.abort = abort
+	f.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+	case <-stop:
+	}
+}
+
+func (f *fakeTransport) close() {}
+
+// fetch один раз возвращает fetchErr, если она задана.
+func (f *fakeTransport) fetch(ctx context.Context) (*Task, error) {
+	f.mutex.Lock()
+	if err := f.fetchErr; err != nil {
+		f.fetchErr = nil
+		f.mutex.Unlock()
+		return nil, err
+	}
+	f.mutex.Unlock()
+
+	select {
+	case task := <-f.tasks:
+		f.mutex.Lock()
+		f.inFlight++
+		f.maxInFlight = max(f.maxInFlight, f.inFlight)
+		f.mutex.Unlock()
+		return task, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *fakeTransport) report(ctx context.Context, result taskResult) error {
+	f.mutex.Lock()
+	f.inFlight--
+	f.mutex.Unlock()
+	f.reports <- result
+	return nil
+}
+
+// state возвращает поле транспорта, прочитанное под мьютексом.
+func (f *fakeTransport) state(read func(f *fakeTransport) int) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return read(f)
+}
+
+func newTestPool(transport Transport, capacity int, shutdownTimeout time.Duration) *Pool {
+	return NewPool(transport, Registration{ID: "agent", Capacity: capacity}, shutdownTimeout)
+}
+
+// startPool запускает пул и возвращает функцию, которая останавливает его и
+// ждёт завершения Run.
+func startPool(t *testing.T, pool *Pool) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pool.Run(ctx)
+	}()
+
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after the context was cancelled")
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func receiveReport(t *testing.T, transport *fakeTransport) taskResult {
+	t.Helper()
+	select {
+	case reply := <-transport.reports:
+		return reply
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a task result")
+		return taskResult{}
+	}
+}
+
+func TestPoolRunsTasksConcurrently(t *testing.T) {
+	t.Parallel()
+	transport := newFakeTransport()
+	for i := range 6 {
+		transport.tasks <- &Task{ID: strconv.Itoa(i), Arg1: float64(i), Arg2: 1, Operation: "+", OperationTime: 100 * time.Millisecond}
+	}
+	startPool(t, newTestPool(transport, 3, time.Second))
+
+	results := make(map[string]float64)
+	for range 6 {
+		reply := receiveReport(t, transport)
+		if reply.Error != "" || reply.Release {
+			t.Errorf("task %s reply = %+v, expected a result", reply.ID, reply)
+		}
+		results[reply.ID] = reply.Result
+	}
+	for i := range 6 {
+		if id := strconv.Itoa(i); results[id] != float64(i+1) {
+			t.Errorf("task %s result = %v, expected %v", id, results[id], i+1)
+		}
+	}
+	if n := transport.state(func(f *fakeTransport) int { return f.maxInFlight }); n != 3 {
+		t.Errorf("pool ran up to %d tasks at once, expected 3", n)
+	}
+}
+
+func TestPoolReleasesUnfinishedTasks(t *testing.T) {
+	t.Parallel()
+	transport := newFakeTransport()
+	transport.tasks <- &Task{ID: "quick", LeaseID: "q", Arg1: 1, Arg2: 2, Operation: "+", OperationTime: 100 * time.Millisecond}
+	transport.tasks <- &Task{ID: "slow", LeaseID: "s", Arg1: 1, Arg2: 2, Operation: "+", OperationTime: time.Hour}
+	stop := startPool(t, newTestPool(transport, 2, 500*time.Millisecond))
+
+	waitFor(t, "both tasks to start", func() bool { return transport.state(func(f *fakeTransport) int { return f.inFlight }) == 2 })
+	stop()
+
+	replies := make(map[string]taskResult)
+	for range 2 {
+		reply := receiveReport(t, transport)
+		replies[reply.ID] = reply
+	}
+	// Начатая задача успевает завершиться за shutdownTimeout, долгая
+	// возвращается оркестратору.
+	if reply := replies["quick"]; reply.Release || reply.Error != "" || reply.Result != 3 {
+		t.Errorf("quick task reply = %+v, expected result 3", reply)
+	}
+	if reply := replies["slow"]; !reply.Release || reply.LeaseID != "s" || reply.Error != "" {
+		t.Errorf("slow task reply = %+v, expected release of lease s", reply)
+	}
+}
+
+func TestPoolAbortsTask(t *testing.T) {
+	t.Parallel()
+	transport := newFakeTransport()
+	transport.tasks <- &Task{ID: "cancelled", Arg1: 1, Arg2: 2, Operation: "+", OperationTime: time.Hour}
+	startPool(t, newTestPool(transport, 1, time.Second))
+
+	var abort func(taskIDs []string)
+	waitFor(t, "the task to start", func() bool {
+		transport.mutex.Lock()
+		defer transport.mutex.Unlock()
+		abort = transport.abort
+		return transport.inFlight == 1 && abort != nil
+	})
+	abort([]string{"unknown", "cancelled"})
+
+	// Прерванная задача остаётся без ответа, а вычислитель берёт следующую.
+	transport.tasks <- &Task{ID: "next", Arg1: 2, Arg2: 3, Operation: "*"}
+	if reply := receiveReport(t, transport); reply.ID != "next" || reply.Result != 6 {
+		t.Errorf("reply = %+v, expected result 6 of the next task", reply)
+	}
+}
+
+func TestPoolReregisters(t *testing.T) {
+	t.Parallel()
+	registrations := func(f *fakeTransport) int { return f.registrations }
+
+	// Оркестратор исключил агента и отвечает на запрос задачи agent_not_found.
+	transport := newFakeTransport()
+	transport.fetchErr = errors.ErrAgentNotFound
+	startPool(t, newTestPool(transport, 1, time.Second))
+	waitFor(t, "re-registration after fetch", func() bool { return transport.state(registrations) == 2 })
+
+	// То же в ответ на сигнал.
+	transport = newFakeTransport()
+	transport.heartbeatErr = errors.ErrAgentNotFound
+	pool := newTestPool(transport, 1, time.Second)
+	pool.heartbeatInterval = 10 * time.Millisecond
+	startPool(t, pool)
+	waitFor(t, "re-registration after heartbeat", func() bool { return transport.state(registrations) == 2 })
+	waitFor(t, "heartbeats to continue", func() bool { return transport.state(func(f *fakeTransport) int { return f.heartbeats }) > 2 })
+	if n := transport.state(registrations); n != 2 {
+		t.Errorf("agent registered %d times, expected 2", n)
+	}
+}
+
+// workServer — сервер Work, который отдаёт каждый открытый поток тесту и
+// держит его, пока тест не закроет end.
+type workServer struct {
+	workerpb.UnimplementedWorkerServer
+	streams chan workStream
+}
+
+type workStream struct {
+	workerpb.Worker_WorkServer
+	end chan struct{}
+}
+
+func (s *workServer) Work(stream workerpb.Worker_WorkServer) error {
+	ws := workStream{Worker_WorkServer: stream, end: make(chan struct{})}
+	s.streams <- ws
+	select {
+	case <-ws.end:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
+
+// newTestGRPCTransport поднимает сервер Work в памяти и создаёт транспорт,
+// подключённый к нему.
+func newTestGRPCTransport(t *testing.T) (*grpcTransport, *workServer) {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	ws := &workServer{streams: make(chan workStream, 1)}
+	workerpb.RegisterWorkerServer(server, ws)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient returned error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &grpcTransport{client: workerpb.NewWorkerClient(conn), tasks: make(chan *Task)}, ws
+}
+
+func (s *workServer) accept(t *testing.T) workStream {
+	t.Helper()
+	select {
+	case stream := <-s.streams:
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a Work stream")
+		return workStream{}
+	}
+}
+
+func recvAgentMessage(t *testing.T, stream workStream) *workerpb.AgentMessage {
+	t.Helper()
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv returned error: %v", err)
+	}
+	return msg
+}
+
+func expectReady(t *testing.T, stream workStream, slots int32) {
+	t.Helper()
+	if ready := recvAgentMessage(t, stream).GetReady(); ready == nil || ready.Slots != slots {
+		t.Fatalf("received %v, expected Ready with %d slots", ready, slots)
+	}
+}
+
+func TestGRPCTransport(t *testing.T) {
+	t.Parallel()
+	transport, server := newTestGRPCTransport(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+		transport.connect(ctx, stop, func([]string) {})
+	}()
+	if err := transport.register(ctx, Registration{ID: "agent", Capacity: 2}); err != nil {
+		t.Fatalf("register returned error: %v", err)
+	}
+
+	first := server.accept(t)
+	if reg := recvAgentMessage(t, first).GetRegister(); reg == nil || reg.AgentId != "agent" || reg.Capacity != 2 {
+		t.Fatalf("received %v, expected registration of agent", reg)
+	}
+
+	// Каждый ждущий вычислитель объявляет одно место.
+	fetched := make(chan *Task, 2)
+	for range 2 {
+		go func() {
+			task, err := transport.fetch(ctx)
+			if err != nil {
+				t.Errorf("fetch returned error: %v", err)
+			}
+			fetched <- task
+		}()
+	}
+	expectReady(t, first, 1)
+	expectReady(t, first, 1)
+
+	// После обрыва поток открывается заново: регистрация повторяется, а все
+	// ждущие места объявляются одним сообщением.
+	close(first.end)
+	second := server.accept(t)
+	if reg := recvAgentMessage(t, second).GetRegister(); reg == nil || reg.AgentId != "agent" {
+		t.Fatalf("received %v after reconnect, expected registration of agent", reg)
+	}
+	expectReady(t, second, 2)
+
+	for _, id := range []string{"1-1", "1-2"} {
+		task := &workerpb.Task{Id: id, Arg1: 1, Arg2: 2, Operation: "+", LeaseId: "lease-" + id}
+		if err := second.Send(&workerpb.OrchestratorMessage{Payload: &workerpb.OrchestratorMessage_Task{Task: task}}); err != nil {
+			t.Fatalf("Send(Task) returned error: %v", err)
+		}
+	}
+	ids := make(map[string]bool)
+	for range 2 {
+		select {
+		case task := <-fetched:
+			if task != nil {
+				ids[task.ID] = task.LeaseID == "lease-"+task.ID
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for fetched tasks")
+		}
+	}
+	if !ids["1-1"] || !ids["1-2"] {
+		t.Errorf("fetched tasks %v, expected 1-1 and 1-2 with their leases", ids)
+	}
+
+	// Вычислитель, переставший ждать, снимает своё место.
+	fetchCtx, stopFetch := context.WithCancel(ctx)
+	go func() {
+		transport.fetch(fetchCtx)
+	}()
+	expectReady(t, second, 1)
+	stopFetch()
+	expectReady(t, second, -1)
+
+	if err := transport.report(ctx, taskResult{ID: "1-1", LeaseID: "lease-1-1", Result: 3}); err != nil {
+		t.Fatalf("report returned error: %v", err)
+	}
+	if result := recvAgentMessage(t, second).GetResult(); result == nil || result.Id != "1-1" || result.Result != 3 {
+		t.Errorf("received %v, expected result 3 of task 1-1", result)
+	}
+
+	// close завершает поток со стороны агента, и connect возвращается.
+	close(stop)
+	transport.close()
+	if _, err := second.Recv(); err != io.EOF {
+		t.Errorf("Recv after close returned %v, expected io.EOF", err)
+	}
+	close(second.end)
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect did not return after close")
+	}
+}
@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// agentState — зарегистрированный агент: его описание, выданные ему аренды
+// и статистика. Поля меняются под мьютексом оркестратора.
+type agentState struct {
+	id            string
+	capacity      int
+	operations    map[string]bool
+	registeredAt  time.Time
+	lastHeartbeat time.Time
+
+	// leases — задачи агента и идентификаторы их аренды.
+	leases    map[string]string
+	completed int
+	failed    int
+	// finished — время завершения задач за последнюю минуту.
+	finished []time.Time
+
+	// cancelled — задачи отменённых выражений, которые агенту ещё не
+	// предложено прервать. HTTP-агент забирает их с сигналом, а поток gRPC
+	// получает их сразу: wake будит его при каждой отмене.
+	cancelled []string
+	wake      chan struct{}
+}
+
+// agentRegistration — описание агента, с которым он регистрируется.
+type agentRegistration struct {
+	ID         string   `json:"id"`
+	Capacity   int      `json:"capacity"`
+	Operations []string `json:"operations"`
+}
+
+// HandleRegisterAgent регистрирует агента или обновляет описание уже
+// известного; статистика агента при повторной регистрации сохраняется.
+func (o *Orchestrator) HandleRegisterAgent(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var req agentRegistration
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errors.ErrInvalidRequest, err))
+		return
+	}
+	if err := o.registerAgent(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": req.ID})
+}
+
+// HandleAgentHeartbeat принимает сигнал POST /internal/agents/{id}/heartbeat.
+// Исключённому агенту отвечает 404, и тот регистрируется заново.
+func (o *Orchestrator) HandleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	id, found := strings.CutSuffix(r.URL.Path[len("/internal/agents/"):], "/heartbeat")
+	if !found || id == "" {
+		writeError(w, errors.ErrAgentNotFound)
+		return
+	}
+	if err := o.heartbeat(id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]string{"cancelled": o.takeCancelled(id)})
+}
+
+func (o *Orchestrator) HandleGetAgents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]models.Agent{"agents": o.listAgents()})
+}
+
+func (o *Orchestrator) registerAgent(req agentRegistration) error {
+	if req.ID == "" || req.Capacity < 1 {
+		return fmt.Errorf("%w: agent id and positive capacity are required", errors.ErrInvalidRequest)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	current := o.scheduler.now()
+	agent, exists := o.agents[req.ID]
+	if !exists {
+		agent = &agentState{id: req.ID, registeredAt: current, leases: make(map[string]string)}
+		o.agents[req.ID] = agent
+		log.Printf("Agent %s registered with capacity %d\n", req.ID, req.Capacity)
+	}
+	agent.capacity = req.Capacity
+	agent.operations = make(map[string]bool)
+	for _, operation := range req.Operations {
+		agent.operations[operation] = true
+	}
+	agent.lastHeartbeat = current
+
+	return nil
+}
+
+func (o *Orchestrator) heartbeat(id string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.evictDeadAgents()
+	agent, exists := o.agents[id]
+	if !exists {
+		return errors.ErrAgentNotFound
+	}
+	agent.lastHeartbeat = o.scheduler.now()
+	return nil
+}
+
+// evictDeadAgents исключает агентов, не присылавших сигналов дольше
+// AgentTimeout, и сразу возвращает в очередь выданные им задачи.
+// Вызывается под мьютексом.
+func (o *Orchestrator) evictDeadAgents() {
+	current := o.scheduler.now()
+	for id, agent := range o.agents {
+		if current.Sub(agent.lastHeartbeat) <= o.config.AgentTimeout {
+			continue
+		}
+
+		for taskID := range o.activeLeases(agent) {
+			o.scheduler.releaseTask(taskID)
+		}
+		delete(o.agents, id)
+		log.Printf("Agent %s evicted after missing heartbeats\n", id)
+	}
+}
+
+// activeLeases возвращает задачи, аренда которых у агента ещё действует, и
+// забывает остальные: они завершены, истекли или выданы заново.
+func (o *Orchestrator) activeLeases(agent *agentState) map[string]string {
+	for taskID, leaseID := range agent.leases {
+		task, exists := o.scheduler.tasks[taskID]
+		if !exists || !o.scheduler.checkLease(task, leaseID) {
+			delete(agent.leases, taskID)
+		}
+	}
+	return agent.leases
+}
+
+// acceptsTask возвращает условие выдачи задачи агенту: операция должна быть в
+// его списке (пустой список — любые операции), а число задач — меньше его
+// ёмкости. Для анонимного получателя условий нет.
+func (o *Orchestrator) acceptsTask(agentID string) (func(*models.Task) bool, error) {
+	if agentID == "" {
+		return nil, nil
+	}
+
+	o.evictDeadAgents()
+	agent, exists := o.agents[agentID]
+	if !exists {
+		return nil, errors.ErrAgentNotFound
+	}
+	if len(o.activeLeases(agent)) >= agent.capacity {
+		return func(*models.Task) bool { return false }, nil
+	}
+	return func(task *models.Task) bool {
+		return len(agent.operations) == 0 || agent.operations[task.Operation]
+	}, nil
+}
+
+// abortExpressionTasks убирает из графа задачи выражения и передаёт уже
+// выданные агентам на прерывание. Возвращает идентификаторы удалённых задач.
+// Вызывается под мьютексом.
+func (o *Orchestrator) abortExpressionTasks(exprID string) []string {
+	removed := o.scheduler.cancelExpressionTasks(exprID)
+	for _, agent := range o.agents {
+		aborted := false
+		for _, taskID := range removed {
+			if _, leased := agent.leases[taskID]; leased {
+				delete(agent.leases, taskID)
+				agent.cancelled = append(agent.cancelled, taskID)
+				aborted = true
+			}
+		}
+		if aborted {
+			agent.signal()
+		}
+	}
+	return removed
+}
+
+// takeCancelled возвращает и забывает задачи, которые агенту нужно прервать.
+func (o *Orchestrator) takeCancelled(id string) []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	cancelled := []string{}
+	if agent, exists := o.agents[id]; exists {
+		cancelled = append(cancelled, agent.cancelled...)
+		agent.cancelled = nil
+	}
+	return cancelled
+}
+
+// watchCancels направляет отмены задач агента в wake: агент подключён
+// потоком и получает их без ожидания сигнала.
+func (o *Orchestrator) watchCancels(id string, wake chan struct{}) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if agent, exists := o.agents[id]; exists {
+		agent.wake = wake
+		if len(agent.cancelled) > 0 {
+			agent.signal()
+		}
+	}
+}
+
+func (a *agentState) signal() {
+	if a.wake == nil {
+		return
+	}
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// recordLease запоминает, что задача выдана агенту. Вызывается под мьютексом.
+func (o *Orchestrator) recordLease(agentID string, task *models.Task) {
+	if agent, exists := o.agents[agentID]; exists {
+		agent.leases[task.ID] = task.LeaseID
+	}
+}
+
+// recordOutcome учитывает ответ по задаче в статистике агента, которому она
+// была выдана, и возвращает его идентификатор. Вызывается под мьютексом до
+// снятия аренды.
+func (o *Orchestrator) recordOutcome(req taskResult) string {
+	for id, agent := range o.agents {
+		if agent.leases[req.ID] != req.LeaseID {
+			continue
+		}
+		delete(agent.leases, req.ID)
+
+		switch {
+		case req.Release:
+		case req.Error != "":
+			agent.failed++
+		default:
+			agent.completed++
+			agent.finished = append(agent.finished, o.scheduler.now())
+		}
+		return id
+	}
+	return ""
+}
+
+func (o *Orchestrator) listAgents() []models.Agent {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.evictDeadAgents()
+	current := o.scheduler.now()
+
+	agents := make([]models.Agent, 0, len(o.agents))
+	for _, agent := range o.agents {
+		recent := agent.finished[:0]
+		for _, at := range agent.finished {
+			if current.Sub(at) < time.Minute {
+				recent = append(recent, at)
+			}
+		}
+		agent.finished = recent
+
+		status := models.AgentHealthy
+		// Агент пропустил хотя бы один сигнал, но ещё не исключён. Запас в
+		// полинтервала прощает сигналы, пришедшие с небольшой задержкой.
+		if current.Sub(agent.lastHeartbeat) > o.config.HeartbeatInterval*3/2 {
+			status = models.AgentUnhealthy
+		}
+
+		currentTasks := make([]string, 0, len(agent.leases))
+		for taskID := range o.activeLeases(agent) {
+			currentTasks = append(currentTasks, taskID)
+		}
+		sort.Strings(currentTasks)
+
+		operations := make([]string, 0, len(agent.operations))
+		for operation := range agent.operations {
+			operations = append(operations, operation)
+		}
+		sort.Strings(operations)
+
+		agents = append(agents, models.Agent{
+			ID:             agent.id,
+			Capacity:       agent.capacity,
+			Operations:     operations,
+			Status:         status,
+			RegisteredAt:   agent.registeredAt,
+			LastHeartbeat:  agent.lastHeartbeat,
+			CurrentTasks:   currentTasks,
+			CompletedTasks: agent.completed,
+			FailedTasks:    agent.failed,
+			TasksPerMinute: len(recent),
+		})
+	}
+
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"net/http"
+	"time"
+)
+
+// maxBatchSize ограничивает число выражений в одном пакете.
+const maxBatchSize = 1000
+
+// batchItem — элемент пакета в ответах API: принятое выражение или ошибка,
+// с которой оно отклонено.
+type batchItem struct {
+	Label      string             `json:"label,omitempty"`
+	ID         string             `json:"id,omitempty"`
+	Expression *models.Expression `json:"expression,omitempty"`
+	Error      *errorResponse     `json:"error,omitempty"`
+}
+
+// batchStatus — состояние пакета, вычисленное по его выражениям.
+type batchStatus struct {
+	ID         string         `json:"id"`
+	Status     string         `json:"status"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Counts     map[string]int `json:"counts"`
+	Items      []batchItem    `json:"items"`
+}
+
+// HandleCalculateBatch принимает пакет выражений. Каждое выражение
+// проверяется отдельно: ошибка в одном не мешает принять остальные.
+func (o *Orchestrator) HandleCalculateBatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	o.submitIdempotent(w, r, o.submitBatch)
+}
+
+// submitBatch принимает выражения пакета и сохраняет сам пакет.
+func (o *Orchestrator) submitBatch(body []byte) (int, any, error) {
+	var req struct {
+		Expressions []calculateRequest `json:"expressions"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errors.ErrInvalidRequest, err)
+	}
+	if len(req.Expressions) == 0 || len(req.Expressions) > maxBatchSize {
+		return 0, nil, fmt.Errorf("%w: batch must contain from 1 to %d expressions", errors.ErrInvalidRequest, maxBatchSize)
+	}
+
+	batch := &models.Batch{ID: newID(), CreatedAt: o.scheduler.now()}
+	items := make([]batchItem, len(req.Expressions))
+	for i, exprReq := range req.Expressions {
+		item := models.BatchItem{Label: exprReq.Label}
+		items[i].Label = exprReq.Label
+
+		expr, err := o.submitExpression(exprReq, batch.ID)
+		if err != nil {
+			item.ErrorCode = errors.Code(err)
+			item.Error = err.Error()
+			items[i].Error = newErrorResponse(err)
+		} else {
+			item.ExpressionID = expr.ID
+			items[i].ID = expr.ID
+		}
+		batch.Items = append(batch.Items, item)
+	}
+
+	if err := o.store.SaveBatch(batch); err != nil {
+		return 0, nil, err
+	}
+
+	return http.StatusCreated, map[string]any{"id": batch.ID, "items": items}, nil
+}
+
+// HandleGetBatch возвращает пакет со статусом, сводкой по статусам и
+// текущим состоянием каждого выражения.
+func (o *Orchestrator) HandleGetBatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	id := r.URL.Path[len("/api/v1/batches/"):]
+
+	status, err := o.batchStatus(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]*batchStatus{"batch": status})
+}
+
+// batchStatus собирает состояние пакета. Пакет вычисляется (pending), пока
+// вычисляется хотя бы одно выражение; затем он завершается ошибкой (error),
+// если хотя бы одно выражение отклонено или завершилось ошибкой, отменён
+// (cancelled), если отменено хотя бы одно, и готов (done) в остальных случаях.
+func (o *Orchestrator) batchStatus(id string) (*batchStatus, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	batch, err := o.store.GetBatch(id)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &batchStatus{
+		ID:        batch.ID,
+		CreatedAt: batch.CreatedAt,
+		Counts:    make(map[string]int),
+		Items:     make([]batchItem, 0, len(batch.Items)),
+	}
+	for _, stored := range batch.Items {
+		item := batchItem{Label: stored.Label, ID: stored.ExpressionID}
+		if stored.ExpressionID == "" {
+			item.Error = &errorResponse{Code: stored.ErrorCode, Message: stored.Error}
+			status.Counts["rejected"]++
+			status.Items = append(status.Items, item)
+			continue
+		}
+
+		expr, err := o.store.GetExpression(stored.ExpressionID)
+		if err != nil {
+			return nil, err
+		}
+		item.Expression = expr
+		status.Counts[expr.Status]++
+		if expr.FinishedAt != nil && (status.FinishedAt == nil || expr.FinishedAt.After(*status.FinishedAt)) {
+			status.FinishedAt = expr.FinishedAt
+		}
+		status.Items = append(status.Items, item)
+	}
+
+	switch {
+	case status.Counts[models.StatusPending] > 0:
+		status.Status = models.StatusPending
+		status.FinishedAt = nil
+	case status.Counts[models.StatusError] > 0 || status.Counts["rejected"] > 0:
+		status.Status = models.StatusError
+	case status.Counts[models.StatusCancelled] > 0:
+		status.Status = models.StatusCancelled
+	default:
+		status.Status = models.StatusDone
+	}
+	if status.Status != models.StatusPending && status.FinishedAt == nil {
+		// Все выражения пакета отклонены: он завершился при создании.
+		status.FinishedAt = &status.CreatedAt
+	}
+
+	return status, nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// resultCache — LRU-кэш результатов подвыражений по их ключу (см.
+// splitter.key). Запись живёт не дольше ttl; при переполнении вытесняется
+// та, к которой дольше всего не обращались. Кэш нулевого размера отключён.
+type resultCache struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// order — записи от самой свежей к самой старой.
+	order *list.List
+
+	// now подменяется в тестах.
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	value   float64
+	expires time.Time
+}
+
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *resultCache) get(key string) (float64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, exists := c.entries[key]
+	if !exists {
+		return 0, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return 0, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *resultCache) add(key string, value float64) {
+	// У задач, сохранённых до появления кэша, ключа нет.
+	if c.size <= 0 || key == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	if elem, exists := c.entries[key]; exists {
+		entry := elem.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"github.com/InsafMin/web_calculator/pkg/calculator"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config — настройки оркестратора.
+type Config struct {
+	// OperationTimes — время выполнения операторов по их знаку.
+	OperationTimes map[string]time.Duration
+	// FunctionTime — время выполнения любой функции из реестра калькулятора.
+	FunctionTime time.Duration
+	// LeaseGrace — запас сверх времени операции на сеть и планирование агента,
+	// после которого аренда задачи истекает.
+	LeaseGrace time.Duration
+	// AgentTimeout — сколько агент может не присылать сигналов о себе, прежде
+	// чем его исключат, а выданные ему задачи вернут в очередь.
+	AgentTimeout time.Duration
+	// HeartbeatInterval — как часто агенты присылают сигналы. Агент, от
+	// которого нет сигнала дольше полутора интервалов, считается unhealthy.
+	HeartbeatInterval time.Duration
+	// WebhookSecret — ключ HMAC-подписи уведомлений на callback_url; пустой
+	// ключ отключает подпись.
+	WebhookSecret string
+	// WebhookAttempts — сколько раз пытаться доставить уведомление.
+	WebhookAttempts int
+	// WebhookBackoff — пауза перед второй попыткой; каждая следующая вдвое дольше.
+	WebhookBackoff time.Duration
+	// WebhookMaxBackoff — предел паузы между попытками.
+	WebhookMaxBackoff time.Duration
+	// WebhookAllowedNetworks — внутренние сети (loopback, частные, link-local),
+	// в которые всё же можно отправлять уведомления. По умолчанию такие
+	// адреса запрещены, чтобы callback_url нельзя было направить на
+	// внутренние сервисы.
+	WebhookAllowedNetworks []netip.Prefix
+	// IdempotencyTTL — сколько хранится ответ на запрос с Idempotency-Key.
+	IdempotencyTTL time.Duration
+	// ResultCacheSize — сколько результатов подвыражений хранит кэш; 0
+	// отключает кэш. ResultCacheTTL — сколько хранится каждый результат.
+	ResultCacheSize int
+	ResultCacheTTL  time.Duration
+	// FoldThreshold — операции над числами, время которых меньше порога,
+	// вычисляются в оркестраторе и не становятся задачами. Нулевой порог
+	// отключает такие вычисления.
+	FoldThreshold time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		OperationTimes: map[string]time.Duration{
+			"+":                 100 * time.Millisecond,
+			"-":                 100 * time.Millisecond,
+			calculator.Negation: 100 * time.Millisecond,
+			"*":                 200 * time.Millisecond,
+			"/":                 200 * time.Millisecond,
+			"//":                200 * time.Millisecond,
+			"%":                 200 * time.Millisecond,
+			"^":                 300 * time.Millisecond,
+		},
+		FunctionTime:      300 * time.Millisecond,
+		LeaseGrace:        5 * time.Second,
+		AgentTimeout:      15 * time.Second,
+		HeartbeatInterval: 5 * time.Second,
+		WebhookAttempts:   5,
+		WebhookBackoff:    time.Second,
+		WebhookMaxBackoff: time.Minute,
+		IdempotencyTTL:    24 * time.Hour,
+		ResultCacheSize:   10000,
+		ResultCacheTTL:    10 * time.Minute,
+	}
+}
+
+// ConfigFromEnv читает настройки из переменных окружения TIME_*_MS,
+// TASK_LEASE_GRACE_MS, AGENT_TIMEOUT_MS, HEARTBEAT_INTERVAL_MS, WEBHOOK_*, IDEMPOTENCY_TTL_MS,
+// RESULT_CACHE_* и FOLD_THRESHOLD_MS; для отсутствующих или некорректных
+// значений остаются значения по умолчанию.
+func ConfigFromEnv() Config {
+	config := DefaultConfig()
+
+	operations := []struct {
+		env        string
+		operations []string
+	}{
+		{"TIME_ADDITION_MS", []string{"+"}},
+		{"TIME_SUBTRACTION_MS", []string{"-", calculator.Negation}},
+		{"TIME_MULTIPLICATIONS_MS", []string{"*"}},
+		{"TIME_DIVISIONS_MS", []string{"/"}},
+		{"TIME_INTEGER_DIVISIONS_MS", []string{"//"}},
+		{"TIME_MODULO_MS", []string{"%"}},
+		{"TIME_EXPONENTIATIONS_MS", []string{"^"}},
+	}
+	for _, op := range operations {
+		if d, ok := envMilliseconds(op.env); ok {
+			for _, operation := range op.operations {
+				config.OperationTimes[operation] = d
+			}
+		}
+	}
+
+	if d, ok := envMilliseconds("TIME_FUNCTIONS_MS"); ok {
+		config.FunctionTime = d
+	}
+	if d, ok := envMilliseconds("TASK_LEASE_GRACE_MS"); ok {
+		config.LeaseGrace = d
+	}
+	if d, ok := envMilliseconds("AGENT_TIMEOUT_MS"); ok {
+		config.AgentTimeout = d
+	}
+	if d, ok := envMilliseconds("HEARTBEAT_INTERVAL_MS"); ok {
+		config.HeartbeatInterval = d
+	}
+	config.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	if attempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		config.WebhookAttempts = attempts
+	}
+	if d, ok := envMilliseconds("WEBHOOK_BACKOFF_MS"); ok {
+		config.WebhookBackoff = d
+	}
+	if d, ok := envMilliseconds("WEBHOOK_MAX_BACKOFF_MS"); ok {
+		config.WebhookMaxBackoff = d
+	}
+	config.WebhookAllowedNetworks = envNetworks("WEBHOOK_ALLOWED_NETWORKS")
+	if d, ok := envMilliseconds("IDEMPOTENCY_TTL_MS"); ok {
+		config.IdempotencyTTL = d
+	}
+	if size, err := strconv.Atoi(os.Getenv("RESULT_CACHE_SIZE")); err == nil && size >= 0 {
+		config.ResultCacheSize = size
+	}
+	if d, ok := envMilliseconds("RESULT_CACHE_TTL_MS"); ok {
+		config.ResultCacheTTL = d
+	}
+	if d, ok := envMilliseconds("FOLD_THRESHOLD_MS"); ok {
+		config.FoldThreshold = d
+	}
+
+	return config
+}
+
+// envNetworks разбирает список сетей через запятую: "10.0.0.0/8" или
+// отдельный адрес "127.0.0.1". Некорректные элементы пропускаются.
+func envNetworks(name string) []netip.Prefix {
+	var networks []netip.Prefix
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		item = strings.TrimSpace(item)
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			networks = append(networks, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(item); err == nil {
+			networks = append(networks, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return networks
+}
+
+func envMilliseconds(name string) (time.Duration, bool) {
+	ms, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+func (c Config) operationTime(operation string) time.Duration {
+	if d, ok := c.OperationTimes[operation]; ok {
+		return d
+	}
+	if calculator.IsFunction(operation) {
+		return c.FunctionTime
+	}
+	return 0
+}
+
+// foldsLocally сообщает, вычисляется ли операция над числами в оркестраторе.
+func (c Config) foldsLocally(operation string) bool {
+	return c.operationTime(operation) < c.FoldThreshold
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Типы событий потока GET /api/v1/expressions/{id}/events.
+const (
+	// eventExpression — состояние выражения в момент подписки.
+	eventExpression     = "expression"
+	eventTaskDispatched = "task_dispatched"
+	eventTaskCompleted  = "task_completed"
+	eventTaskFailed     = "task_failed"
+	eventTaskReleased   = "task_released"
+	// eventResult — последнее событие потока: выражение завершено.
+	eventResult = "result"
+)
+
+const (
+	// eventBuffer — сколько событий может накопиться у медленного
+	// подписчика, прежде чем его поток будет закрыт.
+	eventBuffer = 64
+	// keepAliveInterval — как часто в пустой поток пишется комментарий,
+	// чтобы прокси не закрывали соединение.
+	keepAliveInterval = 15 * time.Second
+)
+
+// expressionEvent — событие хода вычисления выражения.
+type expressionEvent struct {
+	Type         string             `json:"type"`
+	ExpressionID string             `json:"expression_id"`
+	TaskID       string             `json:"task_id,omitempty"`
+	AgentID      string             `json:"agent_id,omitempty"`
+	Operation    string             `json:"operation,omitempty"`
+	Result       *float64           `json:"result,omitempty"`
+	Error        string             `json:"error,omitempty"`
+	Expression   *models.Expression `json:"expression,omitempty"`
+	Time         time.Time          `json:"time"`
+}
+
+// eventHub раздаёт события выражений подписчикам. Публикация не блокируется:
+// переполненный подписчик отключается и при переподключении получит
+// актуальное состояние выражения.
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan expressionEvent]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[string]map[chan expressionEvent]bool)}
+}
+
+// subscribe подписывает на события выражения. Канал закрывается после
+// события result, при переполнении или вызове возвращённой функции отписки.
+func (h *eventHub) subscribe(exprID string) (<-chan expressionEvent, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	events := make(chan expressionEvent, eventBuffer)
+	if h.subscribers[exprID] == nil {
+		h.subscribers[exprID] = make(map[chan expressionEvent]bool)
+	}
+	h.subscribers[exprID][events] = true
+
+	return events, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		h.remove(exprID, events)
+	}
+}
+
+func (h *eventHub) publish(event expressionEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for events := range h.subscribers[event.ExpressionID] {
+		select {
+		case events <- event:
+			if event.Type == eventResult {
+				h.remove(event.ExpressionID, events)
+			}
+		default:
+			h.remove(event.ExpressionID, events)
+		}
+	}
+}
+
+// remove вызывается под mutex.
+func (h *eventHub) remove(exprID string, events chan expressionEvent) {
+	if !h.subscribers[exprID][events] {
+		return
+	}
+	delete(h.subscribers[exprID], events)
+	if len(h.subscribers[exprID]) == 0 {
+		delete(h.subscribers, exprID)
+	}
+	close(events)
+}
+
+// HandleExpressionEvents отдаёт ход вычисления выражения потоком
+// server-sent events: сначала текущее состояние, затем события задач и
+// итоговое событие result, после которого поток закрывается.
+func (o *Orchestrator) HandleExpressionEvents(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	// Подписка и снимок состояния берутся под одним мьютексом, поэтому
+	// между ними не теряется ни одно событие.
+	o.mutex.Lock()
+	expr, err := o.store.GetExpression(id)
+	if err != nil {
+		o.mutex.Unlock()
+		writeError(w, err)
+		return
+	}
+	events, unsubscribe := o.events.subscribe(id)
+	o.mutex.Unlock()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	snapshot := expressionEvent{Type: eventExpression, ExpressionID: id, Expression: expr, Time: o.scheduler.now()}
+	writeEvent(w, snapshot)
+	if expr.Status != models.StatusPending {
+		snapshot.Type = eventResult
+		writeEvent(w, snapshot)
+		flusher.Flush()
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			writeEvent(w, event)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event expressionEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+// publishTask публикует событие задачи. Вызывается под мьютексом.
+func (o *Orchestrator) publishTask(eventType string, task *models.Task, agentID string, result *float64, reason string) {
+	o.events.publish(expressionEvent{
+		Type:         eventType,
+		ExpressionID: task.ExpressionID,
+		TaskID:       task.ID,
+		AgentID:      agentID,
+		Operation:    task.Operation,
+		Result:       result,
+		Error:        reason,
+		Time:         o.scheduler.now(),
+	})
+}
+
+// publishResult публикует итоговое состояние выражения. Вызывается под мьютексом.
+func (o *Orchestrator) publishResult(expr *models.Expression) {
+	exprCopy := *expr
+	o.events.publish(expressionEvent{
+		Type:         eventResult,
+		ExpressionID: expr.ID,
+		Expression:   &exprCopy,
+		Time:         o.scheduler.now(),
+	})
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/internal/workerpb"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"io"
+	"sync"
+)
+
+// maxSlots ограничивает число свободных мест, о которых может сообщить
+// один агент.
+const maxSlots = 1024
+
+// RegisterGRPC регистрирует сервис Worker оркестратора на gRPC-сервере.
+func (o *Orchestrator) RegisterGRPC(server *grpc.Server) {
+	workerpb.RegisterWorkerServer(server, &workerService{o: o})
+}
+
+type workerService struct {
+	workerpb.UnimplementedWorkerServer
+	o *Orchestrator
+}
+
+// Work раздаёт задачи агенту без опроса: каждое сообщение Ready добавляет
+// свободные места, и задача отправляется, как только есть и место, и готовая
+// задача. Результаты и сигналы агента принимаются по тому же потоку.
+func (s *workerService) Work(stream workerpb.Worker_WorkServer) error {
+	sess := &session{
+		o:       s.o,
+		stream:  stream,
+		slots:   make(chan struct{}, maxSlots),
+		cancels: make(chan struct{}, 1),
+	}
+
+	errc := make(chan error, 3)
+	go func() { errc <- sess.dispatch(stream.Context()) }()
+	go func() { errc <- sess.receive() }()
+	go func() { errc <- sess.notify(stream.Context()) }()
+	return <-errc
+}
+
+// session — состояние одного потока Work.
+type session struct {
+	o      *Orchestrator
+	stream workerpb.Worker_WorkServer
+	slots  chan struct{}
+	// cancels будит notify, когда задачи агента нужно прервать.
+	cancels chan struct{}
+
+	sendMutex sync.Mutex
+	// agentID пуст, пока агент не зарегистрировался в этом потоке.
+	agentMutex sync.Mutex
+	agentID    string
+}
+
+func (s *session) send(msg *workerpb.OrchestratorMessage) error {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	return s.stream.Send(msg)
+}
+
+func (s *session) agent() string {
+	s.agentMutex.Lock()
+	defer s.agentMutex.Unlock()
+	return s.agentID
+}
+
+func (s *session) dispatch(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.slots:
+		}
+
+		task, err := s.o.waitTask(ctx, s.agent())
+		if errors.Is(err, errors.ErrAgentNotFound) {
+			// Агент исключён: закрываем поток, при переподключении он
+			// зарегистрируется заново.
+			return status.Error(codes.NotFound, err.Error())
+		}
+		if err != nil {
+			return nil
+		}
+		msg := &workerpb.OrchestratorMessage{
+			Payload: &workerpb.OrchestratorMessage_Task{Task: toProtoTask(task)},
+		}
+		if err := s.send(msg); err != nil {
+			// Задача уже выдана в аренду и вернётся в очередь, когда аренда истечёт.
+			return err
+		}
+	}
+}
+
+// notify отправляет агенту задачи отменённых выражений, которые нужно прервать.
+func (s *session) notify(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.cancels:
+		}
+
+		cancelled := s.o.takeCancelled(s.agent())
+		if len(cancelled) == 0 {
+			continue
+		}
+		msg := &workerpb.OrchestratorMessage{
+			Payload: &workerpb.OrchestratorMessage_Cancel{Cancel: &workerpb.Cancel{TaskIds: cancelled}},
+		}
+		if err := s.send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) receive() error {
+	for {
+		msg, err := s.stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch payload := msg.Payload.(type) {
+		case *workerpb.AgentMessage_Register:
+			reg := payload.Register
+			err := s.o.registerAgent(agentRegistration{
+				ID:         reg.AgentId,
+				Capacity:   int(reg.Capacity),
+				Operations: reg.Operations,
+			})
+			if err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			s.agentMutex.Lock()
+			s.agentID = reg.AgentId
+			s.agentMutex.Unlock()
+			s.o.watchCancels(reg.AgentId, s.cancels)
+		case *workerpb.AgentMessage_Heartbeat:
+			if id := s.agent(); id != "" {
+				if err := s.o.heartbeat(id); err != nil {
+					return status.Error(codes.NotFound, err.Error())
+				}
+			}
+		case *workerpb.AgentMessage_Ready:
+			for i := int32(0); i < payload.Ready.Slots; i++ {
+				select {
+				case s.slots <- struct{}{}:
+				default:
+				}
+			}
+			// Место, под которое задача уже выдаётся, снять нельзя: такую
+			// задачу агент вернёт сам.
+			for i := payload.Ready.Slots; i < 0; i++ {
+				select {
+				case <-s.slots:
+				default:
+				}
+			}
+		case *workerpb.AgentMessage_Result:
+			result := payload.Result
+			ack := &workerpb.ResultAck{Id: result.Id}
+			err := s.o.submitResult(taskResult{
+				ID:      result.Id,
+				LeaseID: result.LeaseId,
+				Result:  result.Result,
+				Error:   result.Error,
+				Release: result.Release,
+			})
+			if err != nil {
+				ack.Code = errors.Code(err)
+				ack.Message = err.Error()
+			}
+			if err := s.send(&workerpb.OrchestratorMessage{Payload: &workerpb.OrchestratorMessage_Ack{Ack: ack}}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func toProtoTask(task *models.Task) *workerpb.Task {
+	return &workerpb.Task{
+		Id:            task.ID,
+		Arg1:          task.Arg1,
+		Arg2:          task.Arg2,
+		Args:          task.Args,
+		Operation:     task.Operation,
+		OperationTime: durationpb.New(task.OperationTime),
+		ExpressionId:  task.ExpressionID,
+		Priority:      int32(task.Priority),
+		LeaseId:       task.LeaseID,
+	}
+}
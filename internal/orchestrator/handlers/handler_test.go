@@ -1,21 +1,44 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/storage"
+	"github.com/InsafMin/web_calculator/internal/workerpb"
+	"github.com/InsafMin/web_calculator/pkg/calculator"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestParseExpression(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
 	tests := []struct {
 		input    string
-		expected []*Task
+		expected []*models.Task
 	}{
 		{
 			"1 + 2",
-			[]*Task{
+			[]*models.Task{
 				{
 					ID:           "1-1",
 					Arg1:         1,
@@ -29,12 +52,13 @@ func TestParseExpression(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result, err := parseExpression(test.input, "1")
+		split, _, err := o.splitExpression(test.input, nil, "1")
 		if err != nil {
-			t.Errorf("parseExpression(%s) returned error: %v", test.input, err)
+			t.Fatalf("o.splitExpression(%s) returned error: %v", test.input, err)
 		}
+		result := split.tasks
 		if len(result) != len(test.expected) {
-			t.Errorf("parseExpression(%s) returned %d tasks, expected %d", test.input, len(result), len(test.expected))
+			t.Errorf("o.splitExpression(%s) returned %d tasks, expected %d", test.input, len(result), len(test.expected))
 		}
 		for i := range result {
 			if result[i].ID != test.expected[i].ID ||
@@ -42,44 +66,367 @@ func TestParseExpression(t *testing.T) {
 				result[i].Arg2 != test.expected[i].Arg2 ||
 				result[i].Operation != test.expected[i].Operation ||
 				result[i].Priority != test.expected[i].Priority {
-				t.Errorf("parseExpression(%s) = %v, expected %v", test.input, result[i], test.expected[i])
+				t.Errorf("o.splitExpression(%s) = %v, expected %v", test.input, result[i], test.expected[i])
 			}
 		}
 	}
 }
 
+func TestParseExpressionUnary(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	split, root, err := o.splitExpression("-3 + 2", nil, "1")
+	if err != nil {
+		t.Fatalf("splitExpression returned error: %v", err)
+	}
+	list := split.tasks
+	if len(list) != 1 || list[0].Arg1 != -3 || list[0].Arg2 != 2 {
+		t.Errorf("negative literal was not folded into the task: %+v", list)
+	}
+	if root.TaskID != "1-1" {
+		t.Errorf("root = %+v, expected task 1-1", root)
+	}
+
+	split, root, err = o.splitExpression("-(2 + 3)", nil, "1")
+	if err != nil {
+		t.Fatalf("splitExpression returned error: %v", err)
+	}
+	list = split.tasks
+	if len(list) != 2 {
+		t.Fatalf("splitExpression returned %d tasks, expected 2", len(list))
+	}
+	neg := list[1]
+	if neg.Operation != calculator.Negation || len(neg.Operands) != 1 || neg.Operands[0].TaskID != "1-1" {
+		t.Errorf("negation task = %+v, expected one operand referring to 1-1", neg)
+	}
+	if root.TaskID != neg.ID {
+		t.Errorf("root = %+v, expected %s", root, neg.ID)
+	}
+}
+
+func TestParseExpressionOperators(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	split, _, err := o.splitExpression("2 ^ 3 ^ 2 // 5 % 4", nil, "1")
+	if err != nil {
+		t.Fatalf("splitExpression returned error: %v", err)
+	}
+	list := split.tasks
+
+	var operations []string
+	for _, task := range list {
+		operations = append(operations, task.Operation)
+		if task.OperationTime != o.config.operationTime(task.Operation) || task.OperationTime == 0 {
+			t.Errorf("task %s has operation time %v", task.ID, task.OperationTime)
+		}
+	}
+
+	expected := []string{"^", "^", "//", "%"}
+	if strings.Join(operations, " ") != strings.Join(expected, " ") {
+		t.Errorf("splitExpression produced operations %v, expected %v", operations, expected)
+	}
+}
+
+func TestParseExpressionFunctions(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	split, root, err := o.splitExpression("max(1, 2 + 3, 4)", nil, "1")
+	if err != nil {
+		t.Fatalf("splitExpression returned error: %v", err)
+	}
+	list := split.tasks
+	if len(list) != 2 {
+		t.Fatalf("splitExpression returned %d tasks, expected 2", len(list))
+	}
+
+	call := list[1]
+	if call.Operation != "max" || len(call.Operands) != 3 || call.Operands[1].TaskID != "1-1" {
+		t.Errorf("function task = %+v, expected max with three operands", call)
+	}
+	if len(call.Args) != 3 || call.Args[0] != 1 || call.Args[2] != 4 {
+		t.Errorf("function task args = %v, expected [1 0 4]", call.Args)
+	}
+	if root.TaskID != call.ID {
+		t.Errorf("root = %+v, expected %s", root, call.ID)
+	}
+}
+
+func TestParseExpressionAgreesWithCalc(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	expressions := []string{"(1 - 2 + 3)", "(8 / 2 * 2)", "2 * (3 - 4 / (1 + 1)) ^ 2", "max(-1, 2) * -(3 % 2)"}
+
+	for _, expression := range expressions {
+		want, err := calculator.Calc(expression)
+		if err != nil {
+			t.Fatalf("Calc(%s) returned error: %v", expression, err)
+		}
+
+		split, root, err := o.splitExpression(expression, nil, "1")
+		if err != nil {
+			t.Fatalf("o.splitExpression(%s) returned error: %v", expression, err)
+		}
+
+		results := make(map[string]float64)
+		for _, task := range split.tasks {
+			args := make([]float64, len(task.Operands))
+			for i, operand := range task.Operands {
+				args[i] = operand.Value
+				if operand.TaskID != "" {
+					args[i] = results[operand.TaskID]
+				}
+			}
+			res, err := calculator.Apply(task.Operation, args)
+			if err != nil {
+				t.Fatalf("task %+v failed: %v", task, err)
+			}
+			results[task.ID] = res
+		}
+
+		if got := results[root.TaskID]; got != want {
+			t.Errorf("distributed result of %s = %v, Calc() = %v", expression, got, want)
+		}
+	}
+}
+
 func TestUpdateTaskArgs(t *testing.T) {
-	tasks := map[string]*Task{
-		"1-1": {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	o.scheduler.addTasks([]*models.Task{
+		{
 			ID:           "1-1",
-			Arg1:         0,
-			Arg2:         2,
+			Operands:     []models.Operand{{Value: 0}, {Value: 2}},
 			Operation:    "+",
 			ExpressionID: "1",
-			Priority:     1,
 		},
-		"1-2": {
+		{
 			ID:           "1-2",
-			Arg1:         0,
-			Arg2:         3,
+			Operands:     []models.Operand{{TaskID: "1-1"}, {Value: 0}},
+			Dependencies: []string{"1-1"},
 			Operation:    "*",
 			ExpressionID: "1",
-			Priority:     2,
 		},
-	}
+		{
+			ID:           "2-1",
+			Operands:     []models.Operand{{Value: 0}, {Value: 0}},
+			Operation:    "+",
+			ExpressionID: "2",
+		},
+	})
 
-	updateTaskArgs(tasks, "1-1", 3)
+	o.scheduler.updateTaskArgs("1-1", 3)
 
-	if tasks["1-2"].Arg1 != 3 {
+	if o.scheduler.tasks["1-2"].Arg1 != 3 {
 		t.Errorf("updateTaskArgs did not update Arg1 in task 1-2")
 	}
+	if o.scheduler.tasks["1-2"].Arg2 != 0 {
+		t.Errorf("updateTaskArgs overwrote the zero literal in task 1-2: %v", o.scheduler.tasks["1-2"].Arg2)
+	}
+	if o.scheduler.tasks["1-1"].Arg1 != 0 || o.scheduler.tasks["2-1"].Arg1 != 0 || o.scheduler.tasks["2-1"].Arg2 != 0 {
+		t.Errorf("updateTaskArgs updated a task that does not depend on 1-1")
+	}
+}
+
+func TestResultRouting(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "(1 + 2) * (3 - 1)"}`))
+	o.HandleCalculate(w, r)
+
+	var created map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("HandleCalculate returned invalid JSON: %v", err)
+	}
+
+	for {
+		w := httptest.NewRecorder()
+		o.HandleTask(w, httptest.NewRequest(http.MethodGet, "/internal/task", nil))
+		if w.Code == http.StatusNotFound {
+			break
+		}
+
+		var response struct {
+			Task models.Task `json:"task"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("HandleTask returned invalid JSON: %v", err)
+		}
+
+		task := response.Task
+		var result float64
+		switch task.Operation {
+		case "+":
+			result = task.Arg1 + task.Arg2
+		case "-":
+			result = task.Arg1 - task.Arg2
+		case "*":
+			result = task.Arg1 * task.Arg2
+		}
+
+		body, _ := json.Marshal(map[string]any{"id": task.ID, "lease_id": task.LeaseID, "result": result})
+		w = httptest.NewRecorder()
+		o.HandleTask(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(string(body))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("HandleTask POST returned status code %d", w.Code)
+		}
+	}
+
+	expr := getExpression(t, o, created["id"])
+	if expr.Status != "done" || expr.Result != 6 {
+		t.Errorf("expression = %+v, expected done with result 6", *expr)
+	}
+}
+
+func TestTaskFailure(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	w := httptest.NewRecorder()
+	o.HandleCalculate(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "1 / 0 + (2 + 3)"}`)))
+
+	var created map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("HandleCalculate returned invalid JSON: %v", err)
+	}
+
+	division, addition := o.scheduler.nextMatchingTask(nil), o.scheduler.nextMatchingTask(nil)
+	if division == nil || addition == nil {
+		t.Fatalf("expected two ready tasks")
+	}
+
+	w = httptest.NewRecorder()
+	o.HandleTask(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(`{"id": "`+division.ID+`", "lease_id": "`+division.LeaseID+`", "error": "division by zero"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleTask POST returned status code %d", w.Code)
+	}
+
+	expr := getExpression(t, o, created["id"])
+	if expr.Status != "error" || expr.Error != "division by zero" {
+		t.Errorf("expression = %+v, expected error status with reason", *expr)
+	}
+	if len(o.scheduler.tasks) != 0 {
+		t.Errorf("remaining tasks of the failed expression were not cancelled: %d left", len(o.scheduler.tasks))
+	}
+
+	w = httptest.NewRecorder()
+	o.HandleTask(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(`{"id": "`+addition.ID+`", "lease_id": "`+addition.LeaseID+`", "result": 5}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("late result for a cancelled task returned status code %d, expected %d", w.Code, http.StatusNotFound)
+	}
+	if expr := getExpression(t, o, created["id"]); expr.Status != "error" {
+		t.Errorf("late result changed expression status to %s", expr.Status)
+	}
+
+	// Бесконечный результат, пришедший по gRPC, — ошибка задачи.
+	expr, err := o.submitExpression(calculateRequest{Expression: "2 ^ 3"}, "")
+	if err != nil {
+		t.Fatalf("submitExpression returned error: %v", err)
+	}
+	power := o.scheduler.nextMatchingTask(nil)
+	if err := o.submitResult(taskResult{ID: power.ID, LeaseID: power.LeaseID, Result: math.Inf(1)}); err != nil {
+		t.Fatalf("submitResult returned error: %v", err)
+	}
+	if expr := getExpression(t, o, expr.ID); expr.Status != models.StatusError || expr.Error != errors.ErrNonFiniteResult.Error() {
+		t.Errorf("expression = %+v, expected non-finite result error", *expr)
+	}
+}
+
+func TestTaskLease(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	current := time.Now()
+	o.scheduler.now = func() time.Time { return current }
+
+	o.scheduler.addTasks([]*models.Task{{
+		ID:            "1-1",
+		Operands:      []models.Operand{{Value: 1}, {Value: 2}},
+		Operation:     "+",
+		OperationTime: time.Second,
+		ExpressionID:  "1",
+	}})
+	o.store.SaveExpression(&models.Expression{ID: "1", Status: "pending", RootTaskID: "1-1"})
+
+	first := o.scheduler.nextMatchingTask(nil)
+	if first == nil {
+		t.Fatalf("expected task 1-1 to be dispatched")
+	}
+	firstLease := first.LeaseID
+	if task := o.scheduler.nextMatchingTask(nil); task != nil {
+		t.Fatalf("leased task %s dispatched twice", task.ID)
+	}
+
+	post := func(leaseID string) int {
+		w := httptest.NewRecorder()
+		body := `{"id": "1-1", "lease_id": "` + leaseID + `", "result": 3}`
+		o.HandleTask(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// Истёкшая аренда недействительна, даже если задачу ещё не выдали заново.
+	current = current.Add(o.scheduler.leaseDuration(first) + time.Millisecond)
+	if code := post(firstLease); code != http.StatusConflict {
+		t.Errorf("result from the expired lease before requeue returned status code %d, expected %d", code, http.StatusConflict)
+	}
+
+	second := o.scheduler.nextMatchingTask(nil)
+	if second == nil || second.ID != "1-1" {
+		t.Fatalf("expired lease was not requeued, got %v", second)
+	}
+	if second.LeaseID == firstLease {
+		t.Fatalf("requeued task kept the expired lease %s", firstLease)
+	}
+
+	if code := post(firstLease); code != http.StatusConflict {
+		t.Errorf("late result from the expired lease returned status code %d, expected %d", code, http.StatusConflict)
+	}
+	if expr := getExpression(t, o, "1"); expr.Status != "pending" {
+		t.Errorf("late result changed the expression: %+v", *expr)
+	}
+	if code := post(second.LeaseID); code != http.StatusOK {
+		t.Errorf("result from the current lease returned status code %d, expected %d", code, http.StatusOK)
+	}
+	// Повтор принятого ответа, например после потерянного ответа
+	// оркестратора, подтверждается, а по прежней аренде — всё так же нет.
+	if code := post(second.LeaseID); code != http.StatusOK {
+		t.Errorf("duplicate result returned status code %d, expected %d", code, http.StatusOK)
+	}
+	if code := post(firstLease); code != http.StatusNotFound {
+		t.Errorf("late result from the expired lease returned status code %d, expected %d", code, http.StatusNotFound)
+	}
+	if expr := getExpression(t, o, "1"); expr.Status != "done" || expr.Result != 3 {
+		t.Errorf("expression = %+v, expected done with result 3", *expr)
+	}
+}
+
+func TestHandleCalculateLiteral(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "5"}`))
+	o.HandleCalculate(w, r)
+
+	var created map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("HandleCalculate returned invalid JSON: %v", err)
+	}
+
+	expr := getExpression(t, o, created["id"])
+	if expr.Status != "done" || expr.Result != 5 {
+		t.Errorf("expression = %+v, expected done with result 5", *expr)
+	}
 }
 
 func TestHandleCalculate(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "1 + 2"}`))
 
-	HandleCalculate(w, r)
+	o.HandleCalculate(w, r)
 
 	if w.Code != http.StatusCreated {
 		t.Errorf("HandleCalculate returned status code %d, expected %d", w.Code, http.StatusCreated)
@@ -95,27 +442,226 @@ func TestHandleCalculate(t *testing.T) {
 	}
 }
 
+// newTestOrchestrator создаёт изолированный оркестратор с хранилищем в памяти.
+func newTestOrchestrator(t *testing.T) *Orchestrator {
+	t.Helper()
+	o, err := NewOrchestrator(storage.NewMemoryStore(), DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewOrchestrator returned error: %v", err)
+	}
+	return o
+}
+
+func getExpression(t *testing.T, o *Orchestrator, id string) *models.Expression {
+	t.Helper()
+	expr, err := o.store.GetExpression(id)
+	if err != nil {
+		t.Fatalf("expression %s: %v", id, err)
+	}
+	return expr
+}
+
+func TestDependencyGraph(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	split, _, err := o.splitExpression("(1 + 2) * (3 + 4)", nil, "1")
+	if err != nil {
+		t.Fatalf("splitExpression returned error: %v", err)
+	}
+	o.scheduler.addTasks(split.tasks)
+
+	first := o.scheduler.nextMatchingTask(nil)
+	second := o.scheduler.nextMatchingTask(nil)
+	if first == nil || second == nil {
+		t.Fatalf("expected both independent branches to be ready, got %v and %v", first, second)
+	}
+	if first.ID != "1-1" || second.ID != "1-2" {
+		t.Errorf("ready tasks = %s, %s, expected 1-1, 1-2", first.ID, second.ID)
+	}
+	if task := o.scheduler.nextMatchingTask(nil); task != nil {
+		t.Fatalf("task %s dispatched before its dependencies finished", task.ID)
+	}
+
+	o.scheduler.completeTask("1-1")
+	if task := o.scheduler.nextMatchingTask(nil); task != nil {
+		t.Fatalf("task %s dispatched with an unfinished dependency", task.ID)
+	}
+
+	o.scheduler.completeTask("1-2")
+	root := o.scheduler.nextMatchingTask(nil)
+	if root == nil || root.ID != "1-3" {
+		t.Fatalf("expected root task 1-3 to be ready, got %v", root)
+	}
+}
+
+func TestHandleCalculateVariables(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "rate * principal", "variables": {"rate": 0.5, "principal": 0}}`))
+	o.HandleCalculate(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("HandleCalculate returned status code %d, expected %d", w.Code, http.StatusCreated)
+	}
+	task := o.scheduler.nextMatchingTask(nil)
+	if task == nil || task.Arg1 != 0.5 || task.Arg2 != 0 {
+		t.Errorf("variables were not substituted: %+v", task)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "rate * months", "variables": {"rate": 0.5}}`))
+	o.HandleCalculate(w, r)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("HandleCalculate returned status code %d for undefined variable, expected %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestHandleCalculateParseError(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "2 * (3 + )"}`))
+	o.HandleCalculate(w, r)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("HandleCalculate returned status code %d, expected %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("HandleCalculate returned Content-Type %q, expected application/json", ct)
+	}
+
+	var response struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Details struct {
+			Offset   int    `json:"offset"`
+			Token    string `json:"token"`
+			Expected string `json:"expected"`
+		} `json:"details"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("HandleCalculate returned invalid JSON: %v", err)
+	}
+
+	if response.Code != "invalid_expression" || response.Details.Offset != 9 || response.Details.Token != ")" {
+		t.Errorf("HandleCalculate returned %+v, expected invalid_expression at offset 9", response)
+	}
+	if stored, _ := o.store.ListExpressions(); len(stored) != 0 {
+		t.Errorf("HandleCalculate stored an expression that failed to parse")
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+		code    string
+	}{
+		{"malformed body", o.HandleCalculate, http.MethodPost, "/api/v1/calculate", `{"expression":`, http.StatusBadRequest, "invalid_request"},
+		{"invalid expression", o.HandleCalculate, http.MethodPost, "/api/v1/calculate", `{"expression": "1 +"}`, http.StatusUnprocessableEntity, "extra_operator"},
+		{"calculate via GET", o.HandleCalculate, http.MethodGet, "/api/v1/calculate", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"invalid limit", o.HandleGetExpressions, http.MethodGet, "/api/v1/expressions?limit=0", "", http.StatusBadRequest, "invalid_request"},
+		{"invalid cursor", o.HandleGetExpressions, http.MethodGet, "/api/v1/expressions?cursor=!", "", http.StatusBadRequest, "invalid_request"},
+		{"invalid status", o.HandleGetExpressions, http.MethodGet, "/api/v1/expressions?status=running", "", http.StatusBadRequest, "invalid_request"},
+		{"invalid created_after", o.HandleGetExpressions, http.MethodGet, "/api/v1/expressions?created_after=yesterday", "", http.StatusBadRequest, "invalid_request"},
+		{"invalid order", o.HandleGetExpressions, http.MethodGet, "/api/v1/expressions?order=random", "", http.StatusBadRequest, "invalid_request"},
+		{"list via POST", o.HandleGetExpressions, http.MethodPost, "/api/v1/expressions", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"unknown expression", o.HandleGetExpression, http.MethodGet, "/api/v1/expressions/42", "", http.StatusNotFound, "expression_not_found"},
+		{"expression via PUT", o.HandleGetExpression, http.MethodPut, "/api/v1/expressions/42", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"no tasks", o.HandleTask, http.MethodGet, "/internal/task", "", http.StatusNotFound, "no_tasks_available"},
+		{"unknown task", o.HandleTask, http.MethodPost, "/internal/task", `{"id": "42-1", "result": 1}`, http.StatusNotFound, "task_not_found"},
+		{"invalid wait", o.HandleTask, http.MethodGet, "/internal/task?wait=soon", "", http.StatusBadRequest, "invalid_request"},
+		{"unknown agent task", o.HandleTask, http.MethodGet, "/internal/task?agent_id=ghost", "", http.StatusNotFound, "agent_not_found"},
+		{"unknown agent heartbeat", o.HandleAgentHeartbeat, http.MethodPost, "/internal/agents/ghost/heartbeat", "", http.StatusNotFound, "agent_not_found"},
+		{"expression route via PUT", o.HandleExpression, http.MethodPut, "/api/v1/expressions/42", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"cancel unknown expression", o.HandleExpression, http.MethodDelete, "/api/v1/expressions/42", "", http.StatusNotFound, "expression_not_found"},
+		{"events of unknown expression", o.HandleExpression, http.MethodGet, "/api/v1/expressions/42/events", "", http.StatusNotFound, "expression_not_found"},
+		{"relative callback_url", o.HandleCalculate, http.MethodPost, "/api/v1/calculate", `{"expression": "1", "callback_url": "/hook"}`, http.StatusBadRequest, "invalid_request"},
+		{"empty batch", o.HandleCalculateBatch, http.MethodPost, "/api/v1/calculate/batch", `{"expressions": []}`, http.StatusBadRequest, "invalid_request"},
+		{"unknown batch", o.HandleGetBatch, http.MethodGet, "/api/v1/batches/42", "", http.StatusNotFound, "batch_not_found"},
+		{"agent without capacity", o.HandleRegisterAgent, http.MethodPost, "/internal/agents", `{"id": "a"}`, http.StatusBadRequest, "invalid_request"},
+		{"malformed result", o.HandleTask, http.MethodPost, "/internal/task", `[]`, http.StatusBadRequest, "invalid_request"},
+		{"task via DELETE", o.HandleTask, http.MethodDelete, "/internal/task", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.handler(w, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+
+			if w.Code != test.status {
+				t.Errorf("status code = %d, expected %d", w.Code, test.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, expected application/json", ct)
+			}
+			if test.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+				t.Errorf("405 response without Allow header")
+			}
+
+			var response struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("invalid JSON: %v", err)
+			}
+			if response.Code != test.code || response.Message == "" {
+				t.Errorf("response = %+v, expected code %s", response, test.code)
+			}
+		})
+	}
+}
+
+func TestWriteJSONEncodingError(t *testing.T) {
+	t.Parallel()
+	w := httptest.NewRecorder()
+	writeJSON(w, http.StatusOK, map[string]float64{"result": math.NaN()})
+
+	var response errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("writeJSON returned invalid JSON: %v", err)
+	}
+	if w.Code != http.StatusInternalServerError || response.Code != "internal_error" {
+		t.Errorf("writeJSON of NaN: status %d, code %q, expected 500 internal_error", w.Code, response.Code)
+	}
+}
+
 func TestHandleTaskGet(t *testing.T) {
-	tasks["1-1"] = &Task{
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	o.scheduler.addTasks([]*models.Task{{
 		ID:           "1-1",
 		Arg1:         1,
 		Arg2:         2,
 		Operation:    "+",
 		ExpressionID: "1",
 		Priority:     1,
-	}
+	}})
 
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest(http.MethodGet, "/internal/task", nil)
 
-	HandleTask(w, r)
+	o.HandleTask(w, r)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("HandleTask returned status code %d, expected %d", w.Code, http.StatusOK)
 	}
 
 	var response struct {
-		Task Task `json:"task"`
+		Task models.Task `json:"task"`
 	}
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Errorf("HandleTask returned invalid JSON: %v", err)
@@ -125,3 +671,1155 @@ func TestHandleTaskGet(t *testing.T) {
 		t.Errorf("HandleTask returned task with ID %s, expected 1-1", response.Task.ID)
 	}
 }
+
+func TestRestoreFromStorage(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "calculator.db")
+	db, err := storage.OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore returned error: %v", err)
+	}
+	o, err := NewOrchestrator(db, DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewOrchestrator returned error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	o.HandleCalculate(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "(1 + 2) * 4"}`)))
+	var created map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("HandleCalculate returned invalid JSON: %v", err)
+	}
+
+	// Первая задача выполнена до перезапуска, вторая выдана, но не завершена.
+	task := o.scheduler.nextMatchingTask(nil)
+	body, _ := json.Marshal(map[string]any{"id": task.ID, "lease_id": task.LeaseID, "result": 3})
+	w = httptest.NewRecorder()
+	o.HandleTask(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleTask POST returned status code %d", w.Code)
+	}
+	if o.scheduler.nextMatchingTask(nil) == nil {
+		t.Fatalf("expected the multiplication to be dispatched")
+	}
+	db.Close()
+
+	db, err = storage.OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore returned error: %v", err)
+	}
+	defer db.Close()
+	o, err = NewOrchestrator(db, DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewOrchestrator returned error: %v", err)
+	}
+
+	task = o.scheduler.nextMatchingTask(nil)
+	if task == nil {
+		t.Fatalf("unfinished task was not restored")
+	}
+	if task.Operation != "*" || task.Arg1 != 3 || task.Arg2 != 4 {
+		t.Fatalf("restored task = %+v, expected 3 * 4", *task)
+	}
+
+	body, _ = json.Marshal(map[string]any{"id": task.ID, "lease_id": task.LeaseID, "result": 12})
+	w = httptest.NewRecorder()
+	o.HandleTask(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleTask POST returned status code %d", w.Code)
+	}
+
+	if expr := getExpression(t, o, created["id"]); expr.Status != "done" || expr.Result != 12 {
+		t.Errorf("expression = %+v, expected done with result 12", *expr)
+	}
+	if left, _ := db.ListTasks(); len(left) != 0 {
+		t.Errorf("completed tasks left in storage: %d", len(left))
+	}
+}
+
+func TestIsolatedOrchestrators(t *testing.T) {
+	t.Parallel()
+
+	first := httptest.NewServer(newTestOrchestrator(t).Handler())
+	defer first.Close()
+	second := httptest.NewServer(newTestOrchestrator(t).Handler())
+	defer second.Close()
+
+	resp, err := http.Post(first.URL+"/api/v1/calculate", "application/json", strings.NewReader(`{"expression": "2 * 3"}`))
+	if err != nil {
+		t.Fatalf("POST /api/v1/calculate failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api/v1/calculate returned status code %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(second.URL + "/internal/task")
+	if err != nil {
+		t.Fatalf("GET /internal/task failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second orchestrator returned status code %d for a task of the first one, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	resp, err = http.Get(first.URL + "/internal/task")
+	if err != nil {
+		t.Fatalf("GET /internal/task failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("first orchestrator returned status code %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// openWorkStream поднимает gRPC-сервер оркестратора в памяти и открывает поток Work.
+func openWorkStream(t *testing.T, o *Orchestrator) workerpb.Worker_WorkClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	o.RegisterGRPC(server)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient returned error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	stream, err := workerpb.NewWorkerClient(conn).Work(ctx)
+	if err != nil {
+		t.Fatalf("Work returned error: %v", err)
+	}
+	return stream
+}
+
+func TestWorkStream(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	stream := openWorkStream(t, o)
+
+	// Место объявлено до появления выражения: задача должна прийти сама,
+	// без повторного запроса.
+	if err := stream.Send(&workerpb.AgentMessage{Payload: &workerpb.AgentMessage_Ready{Ready: &workerpb.Ready{Slots: 1}}}); err != nil {
+		t.Fatalf("Send(Ready) returned error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	o.HandleCalculate(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "2 * 3"}`)))
+	var created map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("HandleCalculate returned invalid JSON: %v", err)
+	}
+
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv returned error: %v", err)
+	}
+	task := msg.GetTask()
+	if task == nil || task.Operation != "*" || task.Arg1 != 2 || task.Arg2 != 3 || task.LeaseId == "" {
+		t.Fatalf("received %v, expected leased task 2 * 3", msg)
+	}
+	if task.OperationTime.AsDuration() != o.config.operationTime("*") {
+		t.Errorf("task operation time = %v, expected %v", task.OperationTime.AsDuration(), o.config.operationTime("*"))
+	}
+
+	result := &workerpb.TaskResult{Id: task.Id, LeaseId: task.LeaseId, Result: 6}
+	if err := stream.Send(&workerpb.AgentMessage{Payload: &workerpb.AgentMessage_Result{Result: result}}); err != nil {
+		t.Fatalf("Send(Result) returned error: %v", err)
+	}
+	msg, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv returned error: %v", err)
+	}
+	if ack := msg.GetAck(); ack == nil || ack.Id != task.Id || ack.Code != "" {
+		t.Fatalf("received %v, expected successful ack for %s", msg, task.Id)
+	}
+	if expr := getExpression(t, o, created["id"]); expr.Status != "done" || expr.Result != 6 {
+		t.Errorf("expression = %+v, expected done with result 6", *expr)
+	}
+
+	// Повторный результат подтверждается так же, как в HTTP API.
+	if err := stream.Send(&workerpb.AgentMessage{Payload: &workerpb.AgentMessage_Result{Result: result}}); err != nil {
+		t.Fatalf("Send(Result) returned error: %v", err)
+	}
+	msg, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv returned error: %v", err)
+	}
+	if ack := msg.GetAck(); ack == nil || ack.Id != task.Id || ack.Code != "" {
+		t.Errorf("received %v, expected successful ack for the duplicate result", msg)
+	}
+}
+
+func TestWakeOneWaiter(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	first, second := o.scheduler.addWaiter(), o.scheduler.addWaiter()
+	o.scheduler.addTasks([]*models.Task{{ID: "1-1", Operands: []models.Operand{{Value: 1}, {Value: 2}}, Operation: "+", ExpressionID: "1"}})
+
+	if len(first) != 1 || len(second) != 0 {
+		t.Fatalf("one ready task woke %d and %d waiters, expected only the first", len(first), len(second))
+	}
+
+	// Первый получатель ушёл, не забрав задачу: сигнал переходит ко второму.
+	if o.scheduler.removeWaiter(first) {
+		o.scheduler.wakeOne()
+	}
+	if len(second) != 1 {
+		t.Errorf("signal of the abandoned waiter was not passed on")
+	}
+}
+
+func TestHandleTaskLongPoll(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			o.HandleTask(w, httptest.NewRequest(http.MethodGet, "/internal/task?wait=1s", nil))
+			codes <- w.Code
+		}()
+	}
+
+	// Ждём, пока оба запроса встанут в ожидание.
+	for {
+		o.mutex.Lock()
+		waiting := len(o.scheduler.waiters)
+		o.mutex.Unlock()
+		if waiting == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	o.HandleCalculate(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "1 + 2"}`)))
+
+	if code := <-codes; code != http.StatusOK {
+		t.Fatalf("first completed long poll returned status code %d, expected %d", code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waiting agent was woken after %v", elapsed)
+	}
+	if code := <-codes; code != http.StatusNotFound {
+		t.Errorf("second long poll returned status code %d, expected %d after timeout", code, http.StatusNotFound)
+	}
+}
+
+func TestTaskRelease(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	o.scheduler.addTasks([]*models.Task{{ID: "1-1", Operands: []models.Operand{{Value: 1}, {Value: 2}}, Operation: "+", ExpressionID: "1"}})
+	o.store.SaveExpression(&models.Expression{ID: "1", Status: "pending", RootTaskID: "1-1"})
+
+	task := o.scheduler.nextMatchingTask(nil)
+	lease := task.LeaseID
+
+	w := httptest.NewRecorder()
+	o.HandleTask(w, httptest.NewRequest(http.MethodPost, "/internal/task", strings.NewReader(`{"id": "1-1", "lease_id": "`+lease+`", "release": true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("HandleTask POST returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+
+	// Задача сразу доступна другому агенту, не дожидаясь истечения аренды.
+	again := o.scheduler.nextMatchingTask(nil)
+	if again == nil || again.ID != "1-1" || again.LeaseID == lease {
+		t.Fatalf("released task was not requeued with a new lease: %+v", again)
+	}
+	if expr := getExpression(t, o, "1"); expr.Status != "pending" {
+		t.Errorf("release changed the expression: %+v", *expr)
+	}
+}
+
+func TestAgents(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	handler := o.Handler()
+
+	current := time.Now()
+	o.scheduler.now = func() time.Time { return current }
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do(http.MethodPost, "/internal/agents", `{"id": "adder", "capacity": 1, "operations": ["+"]}`); w.Code != http.StatusOK {
+		t.Fatalf("registration returned status code %d", w.Code)
+	}
+
+	o.scheduler.addTasks([]*models.Task{
+		{ID: "1-1", Operands: []models.Operand{{Value: 2}, {Value: 3}}, Operation: "*", ExpressionID: "1"},
+		{ID: "1-2", Operands: []models.Operand{{Value: 1}, {Value: 2}}, Operation: "+", ExpressionID: "1"},
+		{ID: "1-3", Operands: []models.Operand{{Value: 3}, {Value: 4}}, Operation: "+", ExpressionID: "1"},
+	})
+	o.store.SaveExpression(&models.Expression{ID: "1", Status: "pending", RootTaskID: "1-3"})
+
+	// Умножение агент не поддерживает: он получает первое сложение, а
+	// умножение остаётся в очереди первым.
+	w := do(http.MethodGet, "/internal/task?agent_id=adder", "")
+	var response struct {
+		Task models.Task `json:"task"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response.Task.ID != "1-2" {
+		t.Fatalf("agent got %d %+v, expected task 1-2", w.Code, response.Task)
+	}
+	if w := do(http.MethodGet, "/internal/task?agent_id=adder", ""); w.Code != http.StatusNotFound {
+		t.Errorf("agent over its capacity got status code %d, expected %d", w.Code, http.StatusNotFound)
+	}
+
+	body, _ := json.Marshal(map[string]any{"id": "1-2", "lease_id": response.Task.LeaseID, "result": 3})
+	if w := do(http.MethodPost, "/internal/task", string(body)); w.Code != http.StatusOK {
+		t.Fatalf("result returned status code %d", w.Code)
+	}
+	w = do(http.MethodGet, "/internal/task?agent_id=adder", "")
+	json.NewDecoder(w.Body).Decode(&response)
+	if response.Task.ID != "1-3" {
+		t.Fatalf("agent got %+v, expected task 1-3", response.Task)
+	}
+
+	var fleet struct {
+		Agents []models.Agent `json:"agents"`
+	}
+	json.NewDecoder(do(http.MethodGet, "/api/v1/agents", "").Body).Decode(&fleet)
+	if len(fleet.Agents) != 1 {
+		t.Fatalf("fleet = %+v, expected one agent", fleet.Agents)
+	}
+	agent := fleet.Agents[0]
+	if agent.ID != "adder" || agent.Status != models.AgentHealthy || agent.CompletedTasks != 1 || agent.TasksPerMinute != 1 ||
+		len(agent.CurrentTasks) != 1 || agent.CurrentTasks[0] != "1-3" {
+		t.Errorf("agent = %+v, expected healthy adder with one completed and one current task", agent)
+	}
+
+	// Сигнал, немного опоздавший, ещё не делает агента unhealthy.
+	current = current.Add(o.config.HeartbeatInterval + 100*time.Millisecond)
+	json.NewDecoder(do(http.MethodGet, "/api/v1/agents", "").Body).Decode(&fleet)
+	if fleet.Agents[0].Status != models.AgentHealthy {
+		t.Errorf("agent with a slightly late heartbeat has status %s", fleet.Agents[0].Status)
+	}
+
+	current = current.Add(o.config.HeartbeatInterval)
+	json.NewDecoder(do(http.MethodGet, "/api/v1/agents", "").Body).Decode(&fleet)
+	if fleet.Agents[0].Status != models.AgentUnhealthy {
+		t.Errorf("agent that missed heartbeats has status %s", fleet.Agents[0].Status)
+	}
+
+	// Агент исключён: его задача сразу возвращается в очередь, а сам он
+	// должен зарегистрироваться заново.
+	current = current.Add(o.config.AgentTimeout)
+	json.NewDecoder(do(http.MethodGet, "/api/v1/agents", "").Body).Decode(&fleet)
+	if len(fleet.Agents) != 0 {
+		t.Errorf("dead agent was not evicted: %+v", fleet.Agents)
+	}
+	if w := do(http.MethodPost, "/internal/agents/adder/heartbeat", ""); w.Code != http.StatusNotFound {
+		t.Errorf("heartbeat of an evicted agent returned status code %d, expected %d", w.Code, http.StatusNotFound)
+	}
+	if task := o.scheduler.nextMatchingTask(func(task *models.Task) bool { return task.Operation == "+" }); task == nil || task.ID != "1-3" {
+		t.Errorf("lease of the evicted agent was not requeued, got %v", task)
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	handler := o.Handler()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	do(http.MethodPost, "/internal/agents", `{"id": "agent", "capacity": 2}`)
+
+	var created map[string]string
+	json.NewDecoder(do(http.MethodPost, "/api/v1/calculate", `{"expression": "(1 + 2) * (3 + 4)"}`).Body).Decode(&created)
+	id := created["id"]
+
+	var leased struct {
+		Task models.Task `json:"task"`
+	}
+	json.NewDecoder(do(http.MethodGet, "/internal/task?agent_id=agent", "").Body).Decode(&leased)
+
+	w := do(http.MethodDelete, "/api/v1/expressions/"+id, "")
+	var response struct {
+		Expression models.Expression `json:"expression"`
+	}
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response.Expression.Status != models.StatusCancelled {
+		t.Fatalf("cancel returned %d %+v, expected cancelled expression", w.Code, response.Expression)
+	}
+	if expr := getExpression(t, o, id); expr.Status != models.StatusCancelled {
+		t.Errorf("stored expression status = %s, expected cancelled", expr.Status)
+	}
+	if tasks, _ := o.store.ListTasks(); len(tasks) != 0 || len(o.scheduler.tasks) != 0 {
+		t.Errorf("cancelled expression left %d stored and %d scheduled tasks", len(tasks), len(o.scheduler.tasks))
+	}
+	if task := o.scheduler.nextMatchingTask(nil); task != nil {
+		t.Errorf("task %s of a cancelled expression is still queued", task.ID)
+	}
+
+	// Агент узнаёт о прерванной задаче со следующим сигналом, и только один раз.
+	for _, expected := range [][]string{{leased.Task.ID}, {}} {
+		var heartbeat struct {
+			Cancelled []string `json:"cancelled"`
+		}
+		json.NewDecoder(do(http.MethodPost, "/internal/agents/agent/heartbeat", "").Body).Decode(&heartbeat)
+		if !reflect.DeepEqual(heartbeat.Cancelled, expected) {
+			t.Errorf("heartbeat cancelled = %v, expected %v", heartbeat.Cancelled, expected)
+		}
+	}
+
+	body, _ := json.Marshal(map[string]any{"id": leased.Task.ID, "lease_id": leased.Task.LeaseID, "result": 3})
+	if w := do(http.MethodPost, "/internal/task", string(body)); w.Code != http.StatusNotFound {
+		t.Errorf("result for a cancelled task returned status code %d, expected %d", w.Code, http.StatusNotFound)
+	}
+	if w := do(http.MethodDelete, "/api/v1/expressions/"+id, ""); w.Code != http.StatusOK {
+		t.Errorf("repeated cancel returned status code %d, expected %d", w.Code, http.StatusOK)
+	}
+
+	json.NewDecoder(do(http.MethodPost, "/api/v1/calculate", `{"expression": "2"}`).Body).Decode(&created)
+	w = do(http.MethodDelete, "/api/v1/expressions/"+created["id"], "")
+	var errResponse errorResponse
+	json.NewDecoder(w.Body).Decode(&errResponse)
+	if w.Code != http.StatusConflict || errResponse.Code != "expression_finished" {
+		t.Errorf("cancel of a finished expression returned %d %q, expected %d expression_finished", w.Code, errResponse.Code, http.StatusConflict)
+	}
+}
+
+func TestWorkStreamCancel(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	stream := openWorkStream(t, o)
+
+	messages := []*workerpb.AgentMessage{
+		{Payload: &workerpb.AgentMessage_Register{Register: &workerpb.Register{AgentId: "agent", Capacity: 1}}},
+		{Payload: &workerpb.AgentMessage_Ready{Ready: &workerpb.Ready{Slots: 1}}},
+	}
+	for _, msg := range messages {
+		if err := stream.Send(msg); err != nil {
+			t.Fatalf("Send returned error: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	o.HandleCalculate(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "2 * 3"}`)))
+	var created map[string]string
+	json.NewDecoder(w.Body).Decode(&created)
+
+	msg, err := stream.Recv()
+	if err != nil || msg.GetTask() == nil {
+		t.Fatalf("Recv returned %v, %v, expected a task", msg, err)
+	}
+	taskID := msg.GetTask().Id
+
+	w = httptest.NewRecorder()
+	o.HandleExpression(w, httptest.NewRequest(http.MethodDelete, "/api/v1/expressions/"+created["id"], nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel returned status code %d", w.Code)
+	}
+
+	// Поток получает отмену сразу, не дожидаясь сигнала агента.
+	msg, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv returned error: %v", err)
+	}
+	if cancel := msg.GetCancel(); cancel == nil || !reflect.DeepEqual(cancel.TaskIds, []string{taskID}) {
+		t.Errorf("received %v, expected cancel of the leased task", msg)
+	}
+}
+
+func TestListExpressions(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	handler := o.Handler()
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	current := start
+	o.scheduler.now = func() time.Time { return current }
+
+	type page struct {
+		Expressions []models.Expression `json:"expressions"`
+		NextCursor  string              `json:"next_cursor"`
+	}
+	list := func(query string) page {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/expressions?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/v1/expressions?%s returned status code %d", query, w.Code)
+		}
+		var response page
+		json.NewDecoder(w.Body).Decode(&response)
+		return response
+	}
+
+	// Пять выражений с интервалом в минуту: чётные вычисляются сразу,
+	// нечётные ждут агента.
+	var ids []string
+	for i, expr := range []string{"1", "1 + 1", "2", "2 + 2", "3"} {
+		current = start.Add(time.Duration(i) * time.Minute)
+		w := httptest.NewRecorder()
+		o.HandleCalculate(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression": "`+expr+`"}`)))
+		var created map[string]string
+		json.NewDecoder(w.Body).Decode(&created)
+		ids = append(ids, created["id"])
+	}
+
+	var paged []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatalf("pagination did not finish after %d pages", pages)
+		}
+		response := list("limit=2&cursor=" + cursor)
+		for _, expr := range response.Expressions {
+			paged = append(paged, expr.ID)
+		}
+		if cursor = response.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(paged, ids) {
+		t.Errorf("paged ids = %v, expected submission order %v", paged, ids)
+	}
+
+	first := list("limit=1").Expressions[0]
+	if !first.CreatedAt.Equal(start) || first.FinishedAt == nil || !first.FinishedAt.Equal(start) {
+		t.Errorf("literal expression created_at = %v, finished_at = %v, expected both %v", first.CreatedAt, first.FinishedAt, start)
+	}
+
+	pending := list("status=pending&order=desc").Expressions
+	if len(pending) != 2 || pending[0].ID != ids[3] || pending[1].ID != ids[1] || pending[0].FinishedAt != nil {
+		t.Errorf("pending expressions in descending order = %+v, expected %s and %s", pending, ids[3], ids[1])
+	}
+
+	from, to := start.Add(time.Minute).Format(time.RFC3339), start.Add(3*time.Minute).Format(time.RFC3339)
+	ranged := list("created_after=" + from + "&created_before=" + to + "&status=done,pending").Expressions
+	if len(ranged) != 2 || ranged[0].ID != ids[1] || ranged[1].ID != ids[2] {
+		t.Errorf("expressions created in [%s, %s) = %+v, expected %s and %s", from, to, ranged, ids[1], ids[2])
+	}
+}
+
+func TestCalculateBatch(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	handler := o.Handler()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	type batchResponse struct {
+		Batch struct {
+			Status     string         `json:"status"`
+			FinishedAt *time.Time     `json:"finished_at"`
+			Counts     map[string]int `json:"counts"`
+			Items      []struct {
+				Label      string             `json:"label"`
+				Expression *models.Expression `json:"expression"`
+				Error      *errorResponse     `json:"error"`
+			} `json:"items"`
+		} `json:"batch"`
+	}
+
+	w := do(http.MethodPost, "/api/v1/calculate/batch", `{"expressions": [
+		{"expression": "1 + 2", "label": "sum"},
+		{"expression": "2 +* 3", "label": "broken"},
+		{"expression": "x", "variables": {"x": 8}, "label": "literal"}
+	]}`)
+	var created struct {
+		ID    string `json:"id"`
+		Items []struct {
+			Label string         `json:"label"`
+			ID    string         `json:"id"`
+			Error *errorResponse `json:"error"`
+		} `json:"items"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Code != http.StatusCreated || created.ID == "" || len(created.Items) != 3 {
+		t.Fatalf("batch returned %d %+v, expected three items", w.Code, created)
+	}
+	sum, broken, literal := created.Items[0], created.Items[1], created.Items[2]
+	if sum.Label != "sum" || sum.ID == "" || sum.Error != nil {
+		t.Errorf("sum item = %+v, expected accepted expression", sum)
+	}
+	if broken.ID != "" || broken.Error == nil || broken.Error.Code != "extra_operator" || broken.Error.Details == nil {
+		t.Errorf("broken item = %+v, expected extra_operator error with details", broken)
+	}
+	if literal.ID == "" || literal.ID == sum.ID {
+		t.Errorf("literal item = %+v, expected its own expression id", literal)
+	}
+	if expr := getExpression(t, o, sum.ID); expr.BatchID != created.ID || expr.Label != "sum" {
+		t.Errorf("expression batch = %q, label = %q, expected %q and sum", expr.BatchID, expr.Label, created.ID)
+	}
+
+	var response batchResponse
+	json.NewDecoder(do(http.MethodGet, "/api/v1/batches/"+created.ID, "").Body).Decode(&response)
+	expectedCounts := map[string]int{"pending": 1, "done": 1, "rejected": 1}
+	if response.Batch.Status != models.StatusPending || !reflect.DeepEqual(response.Batch.Counts, expectedCounts) || response.Batch.FinishedAt != nil {
+		t.Errorf("batch = %+v, expected pending with counts %v", response.Batch, expectedCounts)
+	}
+
+	task := o.scheduler.nextMatchingTask(nil)
+	if err := o.submitResult(taskResult{ID: task.ID, LeaseID: task.LeaseID, Result: 3}); err != nil {
+		t.Fatalf("submitResult returned error: %v", err)
+	}
+
+	// Все выражения завершены, но одно было отклонено.
+	json.NewDecoder(do(http.MethodGet, "/api/v1/batches/"+created.ID, "").Body).Decode(&response)
+	if response.Batch.Status != models.StatusError || response.Batch.FinishedAt == nil {
+		t.Errorf("finished batch = %+v, expected error with finished_at", response.Batch)
+	}
+	items := response.Batch.Items
+	if len(items) != 3 || items[0].Expression.Result != 3 || items[1].Error.Code != "extra_operator" || items[2].Expression.Result != 8 {
+		t.Errorf("batch items = %+v, expected results 3 and 8 around the rejected item", items)
+	}
+
+	json.NewDecoder(do(http.MethodPost, "/api/v1/calculate/batch", `{"expressions": [{"expression": "1"}, {"expression": "2"}]}`).Body).Decode(&created)
+	json.NewDecoder(do(http.MethodGet, "/api/v1/batches/"+created.ID, "").Body).Decode(&response)
+	if response.Batch.Status != models.StatusDone {
+		t.Errorf("batch of literals has status %s, expected done", response.Batch.Status)
+	}
+}
+
+// readEvents читает события SSE-потока, пока он не закроется.
+func readEvents(t *testing.T, resp *http.Response, events chan<- expressionEvent) {
+	defer close(events)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, found := strings.CutPrefix(scanner.Text(), "data: ")
+		if !found {
+			continue
+		}
+		var event expressionEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Errorf("invalid event %q: %v", data, err)
+			return
+		}
+		events <- event
+	}
+}
+
+func TestExpressionEvents(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	server := httptest.NewServer(o.Handler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", strings.NewReader(`{"expression": "(1 + 2) / 0"}`))
+	if err != nil {
+		t.Fatalf("POST /api/v1/calculate returned error: %v", err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/api/v1/expressions/" + created["id"] + "/events")
+	if err != nil {
+		t.Fatalf("GET events returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("events Content-Type = %q, expected text/event-stream", contentType)
+	}
+	events := make(chan expressionEvent)
+	go readEvents(t, resp, events)
+
+	next := func() expressionEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event within 5 seconds")
+			return expressionEvent{}
+		}
+	}
+	if event := next(); event.Type != eventExpression || event.Expression.Status != models.StatusPending {
+		t.Fatalf("first event = %+v, expected snapshot of the pending expression", event)
+	}
+
+	task, _ := o.dispatchTask("")
+	if event := next(); event.Type != eventTaskDispatched || event.TaskID != task.ID || event.Operation != "+" {
+		t.Errorf("event = %+v, expected dispatch of %s", event, task.ID)
+	}
+	o.submitResult(taskResult{ID: task.ID, LeaseID: task.LeaseID, Result: 3})
+	if event := next(); event.Type != eventTaskCompleted || event.Result == nil || *event.Result != 3 {
+		t.Errorf("event = %+v, expected completion with result 3", event)
+	}
+
+	task, _ = o.dispatchTask("")
+	next()
+	o.submitResult(taskResult{ID: task.ID, LeaseID: task.LeaseID, Error: "division by zero"})
+	if event := next(); event.Type != eventTaskFailed || event.Error != "division by zero" {
+		t.Errorf("event = %+v, expected failure with division by zero", event)
+	}
+	if event := next(); event.Type != eventResult || event.Expression.Status != models.StatusError {
+		t.Errorf("event = %+v, expected error result", event)
+	}
+	if event, open := <-events; open {
+		t.Errorf("stream continued after the result with %+v", event)
+	}
+
+	// Поток завершённого выражения сразу отдаёт его состояние и закрывается.
+	resp, err = http.Get(server.URL + "/api/v1/expressions/" + created["id"] + "/events")
+	if err != nil {
+		t.Fatalf("GET events returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	events = make(chan expressionEvent)
+	go readEvents(t, resp, events)
+	var types []string
+	for event := range events {
+		types = append(types, event.Type)
+	}
+	if !reflect.DeepEqual(types, []string{eventExpression, eventResult}) {
+		t.Errorf("finished expression stream = %v, expected snapshot and result", types)
+	}
+}
+
+func TestCallback(t *testing.T) {
+	t.Parallel()
+	config := DefaultConfig()
+	config.WebhookSecret = "secret"
+	config.WebhookAttempts = 3
+	config.WebhookBackoff = 10 * time.Millisecond
+	// Получатель слушает на loopback.
+	config.WebhookAllowedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	// Оба выражения одинаковы: без кэша каждое вычисляется задачей.
+	config.ResultCacheSize = 0
+	o, err := NewOrchestrator(storage.NewMemoryStore(), config)
+	if err != nil {
+		t.Fatalf("NewOrchestrator returned error: %v", err)
+	}
+
+	// Первый получатель отвечает ошибкой один раз, второй — всегда.
+	var calls, failing atomic.Int32
+	payloads := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if r.Header.Get("X-Calculator-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("callback has invalid signature %q", r.Header.Get("X-Calculator-Signature"))
+		}
+		if r.URL.Path == "/failing" {
+			failing.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		payloads <- body
+	}))
+	defer receiver.Close()
+
+	submit := func(callbackURL string) string {
+		expr, err := o.submitExpression(calculateRequest{Expression: "1 + 2", CallbackURL: callbackURL}, "")
+		if err != nil {
+			t.Fatalf("submitExpression returned error: %v", err)
+		}
+		task := o.scheduler.nextMatchingTask(nil)
+		if err := o.submitResult(taskResult{ID: task.ID, LeaseID: task.LeaseID, Result: 3}); err != nil {
+			t.Fatalf("submitResult returned error: %v", err)
+		}
+		return expr.ID
+	}
+	waitCallback := func(id, status string) *models.Callback {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			o.mutex.Lock()
+			expr := getExpression(t, o, id)
+			o.mutex.Unlock()
+			if expr.Callback != nil && expr.Callback.Status == status {
+				return expr.Callback
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("callback of expression %s = %+v, expected status %s", id, expr.Callback, status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	id := submit(receiver.URL + "/hook")
+	callback := waitCallback(id, models.CallbackDelivered)
+	if callback.Attempts != 2 || callback.DeliveredAt == nil || callback.LastError != "" {
+		t.Errorf("callback = %+v, expected delivery on the second attempt", callback)
+	}
+	var payload struct {
+		Event      string            `json:"event"`
+		Expression models.Expression `json:"expression"`
+	}
+	json.Unmarshal(<-payloads, &payload)
+	if payload.Event != "expression.finished" || payload.Expression.ID != id || payload.Expression.Status != models.StatusDone || payload.Expression.Result != 3 {
+		t.Errorf("payload = %+v, expected finished expression %s with result 3", payload, id)
+	}
+
+	id = submit(receiver.URL + "/failing")
+	callback = waitCallback(id, models.CallbackFailed)
+	if callback.Attempts != 3 || failing.Load() != 3 || callback.LastError == "" {
+		t.Errorf("callback = %+v after %d requests, expected three failed attempts", callback, failing.Load())
+	}
+}
+
+func TestCallbackAddresses(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://93.184.216.34:8080/hook", true},
+		{"http://127.0.0.1/hook", false},
+		{"http://localhost:8080/hook", false},
+		{"http://LOCALHOST./hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://192.168.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://[::ffff:127.0.0.1]/hook", false},
+		{"http://0.0.0.0/hook", false},
+	}
+	for _, test := range tests {
+		err := o.validateCallbackURL(test.url)
+		if test.allowed && err != nil {
+			t.Errorf("validateCallbackURL(%s) returned error: %v", test.url, err)
+		}
+		if !test.allowed && !errors.Is(err, errors.ErrInvalidRequest) {
+			t.Errorf("validateCallbackURL(%s) error = %v, expected %v", test.url, err, errors.ErrInvalidRequest)
+		}
+	}
+
+	// Адрес проверяется и при соединении: имя может указывать на внутренний адрес.
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+	if err := o.postCallback(receiver.URL, []byte("{}")); err == nil || calls.Load() != 0 {
+		t.Errorf("callback to loopback returned %v after %d requests, expected refusal", err, calls.Load())
+	}
+
+	// Разрешённая сеть снимает запрет.
+	config := DefaultConfig()
+	config.WebhookAllowedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	allowed, err := NewOrchestrator(storage.NewMemoryStore(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := allowed.validateCallbackURL(receiver.URL); err != nil {
+		t.Errorf("validateCallbackURL(%s) with allowed loopback returned error: %v", receiver.URL, err)
+	}
+	if err := allowed.postCallback(receiver.URL, []byte("{}")); err != nil || calls.Load() != 1 {
+		t.Errorf("callback to allowed loopback returned %v after %d requests", err, calls.Load())
+	}
+}
+
+func TestCallbackDelay(t *testing.T) {
+	t.Parallel()
+	config := DefaultConfig()
+	config.WebhookBackoff = time.Second
+	config.WebhookMaxBackoff = 5 * time.Second
+	o, err := NewOrchestrator(storage.NewMemoryStore(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{64, 5 * time.Second},
+		{1 << 30, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if delay := o.callbackDelay(tt.attempts); delay != tt.expected {
+			t.Errorf("callbackDelay(%d) = %v, expected %v", tt.attempts, delay, tt.expected)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	handler := o.Handler()
+	current := time.Now()
+	o.scheduler.now = func() time.Time { return current }
+
+	post := func(target, key, body string) (*httptest.ResponseRecorder, string) {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var response struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response.ID
+	}
+
+	w, first := post("/api/v1/calculate", "key-1", `{"expression": "1 + 2"}`)
+	if w.Code != http.StatusCreated || len(first) != 26 || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request: status %d, id %q, replayed %q", w.Code, first, w.Header().Get("Idempotent-Replayed"))
+	}
+	w, id := post("/api/v1/calculate", "key-1", `{"expression": "1 + 2"}`)
+	if w.Code != http.StatusCreated || id != first || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: status %d, id %q, replayed %q, expected replay of %q", w.Code, id, w.Header().Get("Idempotent-Replayed"), first)
+	}
+
+	// Одновременные повторы тоже получают одно выражение.
+	ids := make(chan string, 10)
+	for i := 0; i < cap(ids); i++ {
+		go func() {
+			_, id := post("/api/v1/calculate", "key-2", `{"expression": "2 * 3"}`)
+			ids <- id
+		}()
+	}
+	second := <-ids
+	for i := 1; i < cap(ids); i++ {
+		if id := <-ids; id != second {
+			t.Errorf("concurrent retries created expressions %q and %q", second, id)
+		}
+	}
+
+	exprs, _ := o.store.ListExpressions()
+	if len(exprs) != 2 {
+		t.Errorf("store has %d expressions, expected 2", len(exprs))
+	}
+
+	for _, target := range []string{"/api/v1/calculate", "/api/v1/calculate/batch"} {
+		w, _ = post(target, "key-1", `{"expression": "1 + 3"}`)
+		var response errorResponse
+		json.NewDecoder(w.Body).Decode(&response)
+		if w.Code != http.StatusUnprocessableEntity || response.Code != "idempotency_key_reused" {
+			t.Errorf("%s with reused key: status %d, code %q, expected 422 idempotency_key_reused", target, w.Code, response.Code)
+		}
+	}
+
+	w, _ = post("/api/v1/calculate", strings.Repeat("k", 256), `{"expression": "1 + 2"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("too long key: status %d, expected 400", w.Code)
+	}
+
+	w, _ = post("/api/v1/calculate", "key-5", `{"expression": "`+strings.Repeat("1+", maxRequestBodySize/2)+`1"}`)
+	var response errorResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusRequestEntityTooLarge || response.Code != "request_too_large" {
+		t.Errorf("too large body: status %d, code %q, expected 413 request_too_large", w.Code, response.Code)
+	}
+
+	// Запрос с занятым ключом ждёт, запросы с другими ключами — нет.
+	unlock := o.lockKey("key-6")
+	waiting := make(chan string)
+	go func() {
+		_, id := post("/api/v1/calculate", "key-6", `{"expression": "3 + 4"}`)
+		waiting <- id
+	}()
+	if w, _ := post("/api/v1/calculate", "key-7", `{"expression": "3 + 4"}`); w.Code != http.StatusCreated {
+		t.Errorf("request with another key: status %d, expected 201", w.Code)
+	}
+	select {
+	case id := <-waiting:
+		t.Errorf("request with a locked key finished with %q before the lock was released", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if id := <-waiting; id == "" {
+		t.Errorf("request with a released key returned no id")
+	}
+	o.keysMutex.Lock()
+	if len(o.keyLocks) != 0 {
+		t.Errorf("%d key locks left after requests finished", len(o.keyLocks))
+	}
+	o.keysMutex.Unlock()
+
+	// Запрос с ошибкой не запоминается.
+	w, _ = post("/api/v1/calculate", "key-3", `{"expression": "2 +* 3"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid expression: status %d, expected 422", w.Code)
+	}
+	if w, _ = post("/api/v1/calculate", "key-3", `{"expression": "2 + 3"}`); w.Code != http.StatusCreated {
+		t.Errorf("key of failed request: status %d, expected 201", w.Code)
+	}
+
+	_, batch := post("/api/v1/calculate/batch", "key-4", `{"expressions": [{"expression": "1 + 2"}]}`)
+	if _, id := post("/api/v1/calculate/batch", "key-4", `{"expressions": [{"expression": "1 + 2"}]}`); id != batch {
+		t.Errorf("batch retry returned %q, expected %q", id, batch)
+	}
+
+	_, id = post("/api/v1/calculate", "", `{"expression": "1 + 2"}`)
+	if _, other := post("/api/v1/calculate", "", `{"expression": "1 + 2"}`); other == id {
+		t.Errorf("requests without key share id %q", id)
+	}
+
+	current = current.Add(o.config.IdempotencyTTL + time.Second)
+	if _, id := post("/api/v1/calculate", "key-1", `{"expression": "1 + 2"}`); id == first || id == "" {
+		t.Errorf("request after retention window returned %q, expected a new expression", id)
+	}
+}
+
+func TestParseExpressionShared(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	variables := map[string]float64{"a": 2, "b": 3}
+
+	for _, expression := range []string{"(a * b) + (a * b)", "a * b + b * a", "(a*b) + (3 * 2)"} {
+		s, root, err := o.splitExpression(expression, variables, "1")
+		if err != nil {
+			t.Fatalf("splitExpression(%s) returned error: %v", expression, err)
+		}
+		if len(s.tasks) != 2 || s.sharedSubexpressions != 1 {
+			t.Fatalf("splitExpression(%s) produced %d tasks and %d shared subexpressions, expected 2 and 1", expression, len(s.tasks), s.sharedSubexpressions)
+		}
+		product, sum := s.tasks[0], s.tasks[1]
+		if sum.ID != root.TaskID || sum.Operands[0].TaskID != product.ID || sum.Operands[1].TaskID != product.ID || len(sum.Dependencies) != 1 {
+			t.Errorf("splitExpression(%s): sum %+v, expected both operands from %s", expression, sum, product.ID)
+		}
+	}
+
+	// Разные значения переменных — разные подвыражения.
+	s, _, err := o.splitExpression("(a * b) + (a * c)", map[string]float64{"a": 2, "b": 3, "c": 4}, "1")
+	if err != nil {
+		t.Fatalf("splitExpression returned error: %v", err)
+	}
+	if len(s.tasks) != 3 || s.sharedSubexpressions != 0 {
+		t.Errorf("splitExpression produced %d tasks and %d shared subexpressions, expected 3 and 0", len(s.tasks), s.sharedSubexpressions)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	t.Parallel()
+	o := newTestOrchestrator(t)
+	current := time.Now()
+	o.results.now = func() time.Time { return current }
+
+	calculate := func(expression string) *models.Expression {
+		expr, err := o.submitExpression(calculateRequest{Expression: expression}, "")
+		if err != nil {
+			t.Fatalf("submitExpression(%s) returned error: %v", expression, err)
+		}
+		for {
+			task := o.scheduler.nextMatchingTask(nil)
+			if task == nil {
+				break
+			}
+			result, err := calculator.Apply(task.Operation, task.Args)
+			if err != nil {
+				t.Fatalf("task %+v failed: %v", task, err)
+			}
+			if err := o.submitResult(taskResult{ID: task.ID, LeaseID: task.LeaseID, Result: result}); err != nil {
+				t.Fatalf("submitResult returned error: %v", err)
+			}
+		}
+		return getExpression(t, o, expr.ID)
+	}
+
+	if expr := calculate("(1 + 2) * 4"); expr.Result != 12 || expr.CacheHits != 0 {
+		t.Fatalf("first expression = %+v, expected result 12 without cache hits", expr)
+	}
+
+	// Подвыражение 2 + 1 совпадает с уже вычисленным 1 + 2.
+	expr, err := o.submitExpression(calculateRequest{Expression: "(2 + 1) * 5"}, "")
+	if err != nil {
+		t.Fatalf("submitExpression returned error: %v", err)
+	}
+	task := o.scheduler.nextMatchingTask(nil)
+	if expr.CacheHits != 1 || task == nil || task.Arg1 != 3 || task.Operation != "*" {
+		t.Fatalf("expression %+v, task %+v, expected a single task 3 * 5", expr, task)
+	}
+	o.submitResult(taskResult{ID: task.ID, LeaseID: task.LeaseID, Result: 15})
+
+	// Всё выражение уже вычислено: задачи не нужны.
+	if expr := calculate("4 * (1 + 2)"); expr.Status != models.StatusDone || expr.Result != 12 || expr.CacheHits != 1 {
+		t.Errorf("repeated expression = %+v, expected result 12 from cache", expr)
+	}
+
+	current = current.Add(o.config.ResultCacheTTL)
+	if expr := calculate("(1 + 2) * 4"); expr.Result != 12 || expr.CacheHits != 0 {
+		t.Errorf("expression after TTL = %+v, expected recalculation", expr)
+	}
+
+	cache := newResultCache(2, time.Minute)
+	cache.add("a", 1)
+	cache.add("b", 2)
+	cache.get("a")
+	cache.add("c", 3)
+	if _, cached := cache.get("b"); cached {
+		t.Error("least recently used entry was not evicted")
+	}
+	if value, cached := cache.get("a"); !cached || value != 1 {
+		t.Errorf("get(a) = %v, %v, expected 1, true", value, cached)
+	}
+}
+
+func TestCalculatePlan(t *testing.T) {
+	t.Parallel()
+	config := DefaultConfig()
+	// Сложение и вычитание (100 мс) дешевле порога, умножение (200 мс) — нет.
+	config.FoldThreshold = 150 * time.Millisecond
+	o, err := NewOrchestrator(storage.NewMemoryStore(), config)
+	if err != nil {
+		t.Fatalf("NewOrchestrator returned error: %v", err)
+	}
+	handler := o.Handler()
+
+	plan := func(body string) (int, expressionPlan) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate/plan", strings.NewReader(body)))
+		var response struct {
+			Plan expressionPlan `json:"plan"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		return w.Code, response.Plan
+	}
+
+	code, p := plan(`{"expression": "(a + 1) * b * 1", "variables": {"a": 2, "b": 3}}`)
+	if code != http.StatusOK || p.Optimized != "3 * 3" || len(p.Rewrites) != 2 || p.Result != nil {
+		t.Fatalf("plan: status %d, %+v, expected 3 * 3 after two rewrites", code, p)
+	}
+	if len(p.Tasks) != 1 || p.Tasks[0].Operation != "*" || p.Tasks[0].Arg1 != 3 || p.Tasks[0].Arg2 != 3 {
+		t.Errorf("plan tasks = %+v, expected a single task 3 * 3", p.Tasks)
+	}
+
+	if code, p = plan(`{"expression": "2 + 3 - 1"}`); code != http.StatusOK || p.Result == nil || *p.Result != 4 || len(p.Tasks) != 0 {
+		t.Errorf("plan of cheap expression: status %d, %+v, expected result 4 without tasks", code, p)
+	}
+	if code, _ = plan(`{"expression": "2 +* 3"}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("plan of invalid expression: status %d, expected 422", code)
+	}
+	if exprs, _ := o.store.ListExpressions(); len(exprs) != 0 {
+		t.Errorf("plan saved %d expressions", len(exprs))
+	}
+
+	expr, err := o.submitExpression(calculateRequest{Expression: "(a + 1) * b * 1", Variables: map[string]float64{"a": 2, "b": 3}}, "")
+	if err != nil {
+		t.Fatalf("submitExpression returned error: %v", err)
+	}
+	task := o.scheduler.nextMatchingTask(nil)
+	if task == nil || task.Operation != "*" || task.ID != expr.RootTaskID || o.scheduler.nextMatchingTask(nil) != nil {
+		t.Errorf("submitted expression produced task %+v, expected only the root multiplication", task)
+	}
+}
@@ -1,322 +1,634 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
 	"github.com/InsafMin/web_calculator/pkg/calculator"
 	"github.com/InsafMin/web_calculator/pkg/errors"
 	"log"
+	"math"
 	"net/http"
-	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-type Expression struct {
-	ID     string  `json:"id"`
-	Expr   string  `json:"expression"`
-	Status string  `json:"status"`
-	Result float64 `json:"result"`
-}
+const (
+	// maxWait ограничивает длительность долгого опроса GET /internal/task.
+	maxWait = time.Minute
+	// leaseCheckInterval — как часто ждущий задачу получатель проверяет
+	// истёкшие аренды: сами по себе они в очередь не возвращаются.
+	leaseCheckInterval = 500 * time.Millisecond
+)
 
-type Task struct {
-	ID            string        `json:"id"`
-	Arg1          float64       `json:"arg1"`
-	Arg2          float64       `json:"arg2"`
-	Operation     string        `json:"operation"`
-	OperationTime time.Duration `json:"operation_time"`
-	ExpressionID  string        `json:"expression_id"`
-	Priority      int           `json:"priority"`
-	Done          chan bool     `json:"-"`
+// calculateRequest — выражение, отправленное на вычисление отдельно или в
+// составе пакета.
+type calculateRequest struct {
+	Expression string             `json:"expression"`
+	Variables  map[string]float64 `json:"variables"`
+	Label      string             `json:"label"`
+	// CallbackURL получает уведомление о завершении выражения.
+	CallbackURL string `json:"callback_url"`
 }
 
-var (
-	expressions = make(map[string]*Expression)
-	tasks       = make(map[string]*Task)
-	mutex       = &sync.Mutex{}
-)
-
-func HandleCalculate(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Expression string `json:"expression"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusUnprocessableEntity)
+func (o *Orchestrator) HandleCalculate(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
 		return
 	}
 
-	id := fmt.Sprintf("%d", time.Now().UnixNano())
+	o.submitIdempotent(w, r, func(body []byte) (int, any, error) {
+		var req calculateRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", errors.ErrInvalidRequest, err)
+		}
 
-	expr := &Expression{
-		ID:     id,
-		Expr:   req.Expression,
-		Status: "pending",
+		expr, err := o.submitExpression(req, "")
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, map[string]string{"id": expr.ID}, nil
+	})
+}
+
+// submitExpression разбирает выражение, сохраняет его вместе с задачами и
+// ставит задачи в очередь.
+func (o *Orchestrator) submitExpression(req calculateRequest, batchID string) (*models.Expression, error) {
+	if err := o.validateCallbackURL(req.CallbackURL); err != nil {
+		return nil, err
 	}
 
-	mutex.Lock()
-	expressions[id] = expr
-	mutex.Unlock()
+	id := newID()
 
-	tasksList, err := parseExpression(req.Expression, id)
+	s, root, err := o.splitExpression(req.Expression, req.Variables, id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
-		return
+		return nil, err
+	}
+	tasksList := s.tasks
+
+	expr := &models.Expression{
+		ID:          id,
+		Expr:        req.Expression,
+		Variables:   req.Variables,
+		Status:      models.StatusPending,
+		RootTaskID:  root.TaskID,
+		CreatedAt:   o.scheduler.now(),
+		BatchID:     batchID,
+		Label:       req.Label,
+		CallbackURL: req.CallbackURL,
+		CacheHits:   s.cacheHits,
+
+		SharedSubexpressions: s.sharedSubexpressions,
 	}
+	if root.TaskID == "" {
+		expr.Finish(models.StatusDone, expr.CreatedAt)
+		expr.Result = root.Value
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
 
-	mutex.Lock()
+	// Задачи сохраняются раньше выражения, чтобы после перезапуска у
+	// незавершённого выражения всегда нашлись его задачи.
+	if err := o.store.SaveTasks(tasksList...); err != nil {
+		return nil, err
+	}
+	if err := o.store.SaveExpression(expr); err != nil {
+		return nil, err
+	}
 	for _, task := range tasksList {
 		fmt.Printf("Added task: %+v\n", task)
-		tasks[task.ID] = task
 	}
-	mutex.Unlock()
+	o.scheduler.addTasks(tasksList)
+	if expr.Status == models.StatusDone {
+		o.expressionFinished(expr)
+	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"id": id})
+	return expr, nil
 }
 
-func getOperationTime(operation string) time.Duration {
-	var timeMs int
-	var err error
-
-	switch operation {
-	case "+":
-		timeMs, err = strconv.Atoi(os.Getenv("TIME_ADDITION_MS"))
-	case "-":
-		timeMs, err = strconv.Atoi(os.Getenv("TIME_SUBTRACTION_MS"))
-	case "*":
-		timeMs, err = strconv.Atoi(os.Getenv("TIME_MULTIPLICATIONS_MS"))
-	case "/":
-		timeMs, err = strconv.Atoi(os.Getenv("TIME_DIVISIONS_MS"))
-	default:
-		return 0
+func (o *Orchestrator) HandleGetExpressions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
 	}
 
+	query, err := parseExpressionQuery(r.URL.Query())
 	if err != nil {
-		switch operation {
-		case "+":
-			return 100 * time.Millisecond
-		case "-":
-			return 100 * time.Millisecond
-		case "*":
-			return 200 * time.Millisecond
-		case "/":
-			return 200 * time.Millisecond
-		default:
-			return 0
-		}
+		writeError(w, err)
+		return
 	}
 
-	return time.Duration(timeMs) * time.Millisecond
+	o.mutex.Lock()
+	stored, err := o.store.ListExpressions()
+	o.mutex.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	exprs, next := query.page(stored)
+	writeJSON(w, http.StatusOK, struct {
+		Expressions []models.Expression `json:"expressions"`
+		NextCursor  string              `json:"next_cursor,omitempty"`
+	}{
+		Expressions: exprs,
+		NextCursor:  next,
+	})
 }
 
-func HandleGetExpressions(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (o *Orchestrator) HandleGetExpression(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	id := r.URL.Path[len("/api/v1/expressions/"):]
 
-	var exprs []Expression
-	for _, expr := range expressions {
-		exprs = append(exprs, *expr)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	expr, err := o.store.GetExpression(id)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
-	json.NewEncoder(w).Encode(map[string][]Expression{"expressions": exprs})
+	writeJSON(w, http.StatusOK, map[string]models.Expression{"expression": *expr})
 }
 
-func HandleGetExpression(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Path[len("/api/v1/expressions/"):]
-
-	mutex.Lock()
-	defer mutex.Unlock()
+// HandleExpression обслуживает маршрут /api/v1/expressions/{id}: GET
+// возвращает выражение, DELETE отменяет его. Поток событий выражения
+// отдаётся по /api/v1/expressions/{id}/events.
+func (o *Orchestrator) HandleExpression(w http.ResponseWriter, r *http.Request) {
+	if id, found := strings.CutSuffix(r.URL.Path[len("/api/v1/expressions/"):], "/events"); found {
+		o.HandleExpressionEvents(w, r, id)
+		return
+	}
 
-	expr, exists := expressions[id]
-	if !exists {
-		http.Error(w, "Expression not found", http.StatusNotFound)
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]Expression{"expression": *expr})
+	if r.Method == http.MethodDelete {
+		o.HandleCancelExpression(w, r)
+	} else {
+		o.HandleGetExpression(w, r)
+	}
 }
 
-func HandleTask(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		mutex.Lock()
-		defer mutex.Unlock()
+// HandleCancelExpression отменяет незавершённое выражение. Повторная отмена
+// ничего не меняет, а завершённое выражение отменить нельзя.
+func (o *Orchestrator) HandleCancelExpression(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
 
-		var nextTask *Task
-		for _, task := range tasks {
-			if nextTask == nil || task.Priority > nextTask.Priority {
-				nextTask = task
-			}
-		}
+	id := r.URL.Path[len("/api/v1/expressions/"):]
 
-		if nextTask != nil {
-			log.Printf("Sending task to agent: %+v\n", nextTask)
+	expr, err := o.cancelExpression(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-			response := struct {
-				Task Task `json:"task"`
-			}{
-				Task: *nextTask,
-			}
+	writeJSON(w, http.StatusOK, map[string]models.Expression{"expression": *expr})
+}
 
-			delete(tasks, nextTask.ID)
+func (o *Orchestrator) HandleTask(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
 
-			taskCopy := *nextTask
-			taskCopy.Done = nil
+	if r.Method == http.MethodGet {
+		wait, err := parseWait(r.URL.Query().Get("wait"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 
-			response.Task = taskCopy
+		agentID := r.URL.Query().Get("agent_id")
 
-			json.NewEncoder(w).Encode(response)
+		var task *models.Task
+		if wait > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			task, err = o.waitTask(ctx, agentID)
+			cancel()
+		} else {
+			task, err = o.dispatchTask(agentID)
+		}
+		if errors.Is(err, errors.ErrAgentNotFound) {
+			writeError(w, err)
+			return
+		}
+		if task == nil {
+			writeError(w, errors.ErrNoTasksAvailable)
 			return
 		}
 
-		http.Error(w, "No tasks available", http.StatusNotFound)
+		writeJSON(w, http.StatusOK, struct {
+			Task models.Task `json:"task"`
+		}{
+			Task: *task,
+		})
 	} else if r.Method == http.MethodPost {
-		var req struct {
-			ID     string  `json:"id"`
-			Result float64 `json:"result"`
-		}
+		var req taskResult
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusUnprocessableEntity)
+			writeError(w, fmt.Errorf("%w: %v", errors.ErrInvalidRequest, err))
 			return
 		}
 
-		mutex.Lock()
-		defer mutex.Unlock()
-
-		taskID := req.ID
-		exprID := strings.Split(taskID, "-")[0] // ID выражения из ID задачи
-
-		expr, exists := expressions[exprID]
-		if !exists {
-			http.Error(w, "Expression not found", http.StatusNotFound)
+		if err := o.submitResult(req); err != nil {
+			writeError(w, err)
 			return
 		}
 
-		updateTaskArgs(tasks, taskID, req.Result)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// taskResult — ответ агента по задаче: результат, причина, по которой
+// задачу выполнить не удалось, или отказ от неё.
+type taskResult struct {
+	ID      string  `json:"id"`
+	LeaseID string  `json:"lease_id"`
+	Result  float64 `json:"result"`
+	Error   string  `json:"error"`
+	// Release возвращает задачу в очередь невыполненной.
+	Release bool `json:"release"`
+}
+
+// dispatchTask выдаёт в аренду следующую готовую задачу, которую может взять
+// агент agentID (пустой — анонимный получатель), и возвращает её копию или
+// nil, если подходящих задач нет.
+func (o *Orchestrator) dispatchTask(agentID string) (*models.Task, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.dispatchTaskLocked(agentID)
+}
+
+func (o *Orchestrator) dispatchTaskLocked(agentID string) (*models.Task, error) {
+	accept, err := o.acceptsTask(agentID)
+	if err != nil {
+		return nil, err
+	}
 
-		allTasksDone := true
-		for _, t := range tasks {
-			if t.ExpressionID == exprID {
-				allTasksDone = false
-				break
+	task := o.scheduler.nextMatchingTask(accept)
+	if task == nil {
+		return nil, nil
+	}
+	o.recordLease(agentID, task)
+	o.publishTask(eventTaskDispatched, task, agentID, nil, "")
+	log.Printf("Sending task to agent %s: %+v\n", agentID, task)
+
+	return copyTask(task), nil
+}
+
+func copyTask(task *models.Task) *models.Task {
+	taskCopy := *task
+	taskCopy.Done = nil
+	return &taskCopy
+}
+
+// waitTask ждёт появления задачи, которую может взять агент agentID, и
+// выдаёт её в аренду.
+func (o *Orchestrator) waitTask(ctx context.Context, agentID string) (*models.Task, error) {
+	for {
+		o.mutex.Lock()
+		task, err := o.dispatchTaskLocked(agentID)
+		if task != nil || err != nil {
+			o.mutex.Unlock()
+			return task, err
+		}
+		// Задачу, которую агент не может взять, он пропускает. Другие
+		// подходящие агенты заберут её не позже чем через leaseCheckInterval.
+		wake := o.scheduler.addWaiter()
+		o.mutex.Unlock()
+
+		select {
+		case <-wake:
+		case <-time.After(leaseCheckInterval):
+			o.mutex.Lock()
+			o.scheduler.removeWaiter(wake)
+			o.mutex.Unlock()
+		case <-ctx.Done():
+			o.mutex.Lock()
+			if o.scheduler.removeWaiter(wake) {
+				// Сигнал пришёл, но задачу мы уже не возьмём: передаём его
+				// следующему, чтобы задача не осталась без получателя.
+				o.scheduler.wakeOne()
 			}
+			o.mutex.Unlock()
+			return nil, ctx.Err()
 		}
+	}
+}
 
-		if allTasksDone {
-			expr.Result = req.Result
-			expr.Status = "done"
-		}
+// parseWait разбирает параметр wait: длительность в формате Go ("30s") или
+// число секунд. Пустое значение означает ответ без ожидания.
+func parseWait(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
 
-		w.WriteHeader(http.StatusOK)
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, fmt.Errorf("%w: invalid wait %q", errors.ErrInvalidRequest, value)
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("%w: negative wait %q", errors.ErrInvalidRequest, value)
 	}
+	return min(wait, maxWait), nil
 }
 
-func updateTaskArgs(tasks map[string]*Task, taskID string, result float64) {
-	for _, task := range tasks {
-		if task.Arg1 == 0 && strings.HasPrefix(taskID, task.ExpressionID) {
-			task.Arg1 = result
+// submitResult принимает ответ агента по задаче и продвигает выражение.
+// Повтор уже принятого ответа подтверждается без изменений.
+func (o *Orchestrator) submitResult(req taskResult) (err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	taskID := req.ID
+	if o.scheduler.wasApplied(taskID, req.LeaseID) {
+		return nil
+	}
+	task, exists := o.scheduler.tasks[taskID]
+	if !exists {
+		return errors.ErrTaskNotFound
+	}
+	if !o.scheduler.checkLease(task, req.LeaseID) {
+		// Ответ по истёкшей или чужой аренде: задача уже выдана заново
+		// либо ещё не выдавалась, состояние не меняем.
+		return errors.ErrLeaseExpired
+	}
+	defer func() {
+		if err == nil {
+			o.scheduler.markApplied(taskID, req.LeaseID)
+		}
+	}()
+	// Бесконечность или NaN от агента по gRPC нельзя отдать клиенту в JSON.
+	if req.Error == "" && !req.Release && (math.IsInf(req.Result, 0) || math.IsNaN(req.Result)) {
+		req.Error = errors.ErrNonFiniteResult.Error()
+	}
+	agentID := o.recordOutcome(req)
+	if req.Release {
+		log.Printf("Task %s released by agent\n", taskID)
+		o.scheduler.releaseTask(taskID)
+		o.publishTask(eventTaskReleased, task, agentID, nil, "")
+		return nil
+	}
+	exprID := task.ExpressionID
+
+	expr, err := o.store.GetExpression(exprID)
+	if err != nil {
+		return err
+	}
+
+	if req.Error != "" {
+		log.Printf("Task %s failed: %s\n", taskID, req.Error)
+		expr.Finish(models.StatusError, o.scheduler.now())
+		expr.Error = req.Error
+		if err := o.store.SaveExpression(expr); err != nil {
+			return err
+		}
+		if err := o.store.DeleteTasks(o.abortExpressionTasks(exprID)...); err != nil {
+			return err
 		}
-		if task.Arg2 == 0 && strings.HasPrefix(taskID, task.ExpressionID) {
-			task.Arg2 = result
+		o.publishTask(eventTaskFailed, task, agentID, nil, req.Error)
+		o.expressionFinished(expr)
+		return nil
+	}
+
+	// Порядок записи важен для восстановления после перезапуска: сначала
+	// результат попадает в дочерние задачи или выражение и только потом
+	// выполненная задача удаляется.
+	if err := o.store.SaveTasks(o.scheduler.updateTaskArgs(taskID, req.Result)...); err != nil {
+		return err
+	}
+	if taskID == expr.RootTaskID {
+		expr.Result = req.Result
+		expr.Finish(models.StatusDone, o.scheduler.now())
+		if err := o.store.SaveExpression(expr); err != nil {
+			return err
 		}
 	}
+	if err := o.store.DeleteTasks(taskID); err != nil {
+		return err
+	}
+	o.results.add(task.Key, req.Result)
+	o.scheduler.completeTask(taskID)
+	o.publishTask(eventTaskCompleted, task, agentID, &req.Result, "")
+	if expr.Status == models.StatusDone {
+		o.expressionFinished(expr)
+	}
+
+	return nil
 }
 
-func parseExpression(expr string, exprID string) ([]*Task, error) {
-	tokens, err := calculator.Tokenize(expr)
+// cancelExpression переводит выражение в статус cancelled, убирает его задачи
+// из очереди и просит агентов прервать уже выданные.
+func (o *Orchestrator) cancelExpression(id string) (*models.Expression, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	expr, err := o.store.GetExpression(id)
 	if err != nil {
 		return nil, err
 	}
+	switch expr.Status {
+	case models.StatusCancelled:
+		return expr, nil
+	case models.StatusPending:
+	default:
+		return nil, fmt.Errorf("%w: expression %s is %s", errors.ErrExpressionFinished, id, expr.Status)
+	}
 
-	rpn, err := calculator.ToRPN(tokens)
-	if err != nil {
+	// Как и при ошибке задачи, выражение сохраняется раньше удаления задач:
+	// после перезапуска задачи отменённого выражения не возобновятся.
+	expr.Finish(models.StatusCancelled, o.scheduler.now())
+	if err := o.store.SaveExpression(expr); err != nil {
+		return nil, err
+	}
+	if err := o.store.DeleteTasks(o.abortExpressionTasks(id)...); err != nil {
 		return nil, err
 	}
+	log.Printf("Expression %s cancelled\n", id)
+	o.expressionFinished(expr)
 
-	bracketLevels := getBracketLevels(tokens, rpn)
+	return expr, nil
+}
 
-	var tasks []*Task
-	var stack []string
-	taskMap := make(map[string]string)
-	taskCounter := 1
+// splitExpression разбивает выражение на задачи и возвращает splitter вместе
+// с корневым аргументом, значение которого и есть результат выражения. Кроме
+// задач в splitter есть упрощённое выражение и посчитано, сколько подвыражений
+// удалось не вычислять. Перед разбиением выражение упрощается
+// calculator.Optimize.
+func (o *Orchestrator) splitExpression(expr string, variables map[string]float64, exprID string) (*splitter, models.Operand, error) {
+	node, err := calculator.Parse(expr)
+	if err != nil {
+		return nil, models.Operand{}, err
+	}
+	optimized, rewrites, err := calculator.Optimize(node, variables, o.config.foldsLocally)
+	if err != nil {
+		return nil, models.Operand{}, err
+	}
 
-	for _, token := range rpn {
-		if _, err := strconv.ParseFloat(token, 64); err == nil {
-			stack = append(stack, token)
-		} else if calculator.IsOperator(rune(token[0])) {
-			if len(stack) < 2 {
-				return nil, errors.ErrInvalidExpression
-			}
+	s := &splitter{
+		optimized: optimized,
+		rewrites:  rewrites,
+		exprID:    exprID,
+		variables: variables,
+		config:    o.config,
+		results:   o.results,
+		keys:      make(map[calculator.Node]string),
+		shared:    make(map[string]models.Operand),
+	}
+	root, err := s.split(optimized)
+	if err != nil {
+		return nil, models.Operand{}, err
+	}
 
-			arg2 := stack[len(stack)-1]
-			arg1 := stack[len(stack)-2]
-			stack = stack[:len(stack)-2]
+	return s, root, nil
+}
 
-			taskID := fmt.Sprintf("%s-%d", exprID, taskCounter)
+// splitter обходит дерево выражения снизу вверх и превращает каждую операцию
+// в задачу, аргументы которой ссылаются на задачи дочерних узлов. Одинаковые
+// подвыражения внутри выражения вычисляются одной задачей, а уже известные
+// результаты берутся из кэша.
+type splitter struct {
+	// optimized — упрощённое дерево выражения, rewrites — сделанные упрощения.
+	optimized calculator.Node
+	rewrites  []calculator.Rewrite
+
+	exprID    string
+	variables map[string]float64
+	config    Config
+	results   *resultCache
+	tasks     []*models.Task
+
+	// keys — ключи уже разобранных узлов, shared — задачи по ключу.
+	keys   map[calculator.Node]string
+	shared map[string]models.Operand
+
+	cacheHits            int
+	sharedSubexpressions int
+}
 
-			if val, exists := taskMap[arg1]; exists {
-				arg1 = val
-			}
-			if val, exists := taskMap[arg2]; exists {
-				arg2 = val
-			}
+// key возвращает ключ подвыражения: одинаковые после подстановки переменных
+// подвыражения получают одинаковый ключ. У числа ключ — само значение, у
+// операции — SHA-256 операции и ключей аргументов; аргументы + и *
+// сортируются, поэтому a*b и b*a совпадают.
+func (s *splitter) key(node calculator.Node) (string, error) {
+	if key, exists := s.keys[node]; exists {
+		return key, nil
+	}
 
-			priority := calculator.Priority(token) + bracketLevels[token]
-
-			task := &Task{
-				ID:            taskID,
-				Arg1:          parseNumber(arg1),
-				Arg2:          parseNumber(arg2),
-				Operation:     token,
-				ExpressionID:  exprID,
-				Priority:      priority,
-				OperationTime: getOperationTime(token),
-				Done:          make(chan bool),
+	var key string
+	switch n := node.(type) {
+	case *calculator.NumberNode:
+		key = "=" + strconv.FormatFloat(n.Value, 'g', -1, 64)
+	case *calculator.IdentNode:
+		value, err := n.Resolve(s.variables)
+		if err != nil {
+			return "", err
+		}
+		key = "=" + strconv.FormatFloat(value, 'g', -1, 64)
+	case calculator.OperationNode:
+		args := make([]string, 0, len(n.Args()))
+		for _, arg := range n.Args() {
+			argKey, err := s.key(arg)
+			if err != nil {
+				return "", err
 			}
-			tasks = append(tasks, task)
-
-			resultKey := fmt.Sprintf("task-%s", taskID)
-			taskMap[resultKey] = taskID
-
-			stack = append(stack, resultKey)
-
-			taskCounter++
+			args = append(args, argKey)
+		}
+		if operation := n.Operation(); operation == "+" || operation == "*" {
+			sort.Strings(args)
 		}
+		hash := sha256.Sum256([]byte(n.Operation() + "(" + strings.Join(args, ",") + ")"))
+		key = hex.EncodeToString(hash[:])
+	default:
+		return "", errors.ErrInvalidExpression
 	}
 
-	return tasks, nil
+	s.keys[node] = key
+	return key, nil
 }
 
-func getBracketLevels(tokens []string, rpn []string) map[string]int {
-	bracketLevels := make(map[string]int)
-
-	currentLevel := 0
-	tokenLevels := make(map[string]int)
+func (s *splitter) split(node calculator.Node) (models.Operand, error) {
+	switch n := node.(type) {
+	case *calculator.NumberNode:
+		return models.Operand{Value: n.Value}, nil
+	case *calculator.IdentNode:
+		value, err := n.Resolve(s.variables)
+		if err != nil {
+			return models.Operand{}, err
+		}
+		return models.Operand{Value: value}, nil
+	case calculator.OperationNode:
+		key, err := s.key(n)
+		if err != nil {
+			return models.Operand{}, err
+		}
+		if operand, exists := s.shared[key]; exists {
+			s.sharedSubexpressions++
+			return operand, nil
+		}
+		if value, cached := s.results.get(key); cached {
+			s.cacheHits++
+			return models.Operand{Value: value}, nil
+		}
 
-	for _, token := range tokens {
-		if token == "(" {
-			currentLevel += 2
-		} else if token == ")" {
-			currentLevel -= 2
-		} else if calculator.IsOperator(rune(token[0])) {
-			tokenLevels[token] = currentLevel
+		var operands []models.Operand
+		var dependencies []string
+		for _, arg := range n.Args() {
+			operand, err := s.split(arg)
+			if err != nil {
+				return models.Operand{}, err
+			}
+			operands = append(operands, operand)
+			if operand.TaskID != "" && !slices.Contains(dependencies, operand.TaskID) {
+				dependencies = append(dependencies, operand.TaskID)
+			}
 		}
-	}
 
-	for _, token := range rpn {
-		if calculator.IsOperator(rune(token[0])) {
-			bracketLevels[token] = tokenLevels[token]
+		operation := n.Operation()
+
+		// Знак перед числом — это просто отрицательный литерал, отдельная
+		// задача для него не нужна.
+		if calculator.IsUnary(operation) && operands[0].TaskID == "" {
+			res, err := calculator.ResolveUnary(operands[0].Value, operation)
+			if err != nil {
+				return models.Operand{}, err
+			}
+			return models.Operand{Value: res}, nil
 		}
-	}
 
-	return bracketLevels
-}
+		task := &models.Task{
+			ID:            fmt.Sprintf("%s-%d", s.exprID, len(s.tasks)+1),
+			Operation:     operation,
+			ExpressionID:  s.exprID,
+			Priority:      calculator.Priority(operation),
+			OperationTime: s.config.operationTime(operation),
+			Operands:      operands,
+			Dependencies:  dependencies,
+			Key:           key,
+			Done:          make(chan bool),
+		}
+		task.SyncArgs()
+		s.tasks = append(s.tasks, task)
 
-func parseNumber(s string) float64 {
-	if strings.HasPrefix(s, "task-") {
-		return 0
+		operand := models.Operand{TaskID: task.ID}
+		s.shared[key] = operand
+		return operand, nil
+	default:
+		return models.Operand{}, errors.ErrInvalidExpression
 	}
-	num, _ := strconv.ParseFloat(s, 64)
-	return num
 }
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// replayedHeader отмечает ответ, повторённый по Idempotency-Key.
+	replayedHeader          = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+	// idempotencyPurgeInterval — как часто из хранилища удаляются истёкшие ключи.
+	idempotencyPurgeInterval = time.Minute
+	// maxRequestBodySize ограничивает тело запроса на вычисление; его хватает
+	// на пакет из maxBatchSize выражений.
+	maxRequestBodySize = 4 << 20
+)
+
+// keyLock — блокировка одного Idempotency-Key; refs — сколько запросов её
+// держат или ждут.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// submitIdempotent читает тело запроса, передаёт его submit и отвечает
+// результатом. Если в запросе есть Idempotency-Key, успешный ответ
+// сохраняется: повторный запрос с тем же ключом и телом в течение
+// IdempotencyTTL получает его снова, а новые выражения не создаются.
+func (o *Orchestrator) submitIdempotent(w http.ResponseWriter, r *http.Request, submit func(body []byte) (int, any, error)) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, fmt.Errorf("%w: limit is %d bytes", errors.ErrRequestTooLarge, tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errors.ErrInvalidRequest, err))
+		return
+	}
+
+	key := r.Header.Get(idempotencyHeader)
+	if key == "" {
+		status, response, err := submit(body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, status, response)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(w, fmt.Errorf("%w: %s must not exceed %d characters", errors.ErrInvalidRequest, idempotencyHeader, maxIdempotencyKeyLength))
+		return
+	}
+
+	// Запросы с одним ключом выполняются по одному, чтобы одновременные
+	// повторы не создали выражения дважды; разные ключи друг друга не ждут.
+	defer o.lockKey(key)()
+
+	hash := requestHash(r.URL.Path, body)
+	stored, err := o.idempotencyKey(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if stored != nil {
+		if stored.RequestHash != hash {
+			writeError(w, errors.ErrIdempotencyKeyReused)
+			return
+		}
+		w.Header().Set(replayedHeader, "true")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(stored.StatusCode)
+		w.Write(append(stored.Response, '\n'))
+		return
+	}
+
+	status, response, err := submit(body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Выражения уже приняты, поэтому ошибка сохранения ключа только
+	// записывается в лог: повтор запроса создаст их заново.
+	data, err := json.Marshal(response)
+	if err == nil {
+		err = o.store.SaveIdempotencyKey(&models.IdempotencyKey{
+			Key:         key,
+			RequestHash: hash,
+			StatusCode:  status,
+			Response:    data,
+			CreatedAt:   o.scheduler.now(),
+		})
+	}
+	if err != nil {
+		log.Printf("Could not save idempotency key %q: %v\n", key, err)
+	}
+	writeJSON(w, status, response)
+}
+
+// lockKey захватывает блокировку ключа и возвращает функцию, которая её
+// отпускает. Блокировка удаляется, когда её больше никто не ждёт.
+func (o *Orchestrator) lockKey(key string) func() {
+	o.keysMutex.Lock()
+	lock, exists := o.keyLocks[key]
+	if !exists {
+		lock = &keyLock{}
+		o.keyLocks[key] = lock
+	}
+	lock.refs++
+	o.keysMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		o.keysMutex.Lock()
+		defer o.keysMutex.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(o.keyLocks, key)
+		}
+	}
+}
+
+// idempotencyKey возвращает сохранённый ответ по ключу или nil, если ключа
+// нет или он старше IdempotencyTTL. Заодно раз в idempotencyPurgeInterval
+// удаляет истёкшие ключи. Вызывается под блокировкой ключа.
+func (o *Orchestrator) idempotencyKey(key string) (*models.IdempotencyKey, error) {
+	current := o.scheduler.now()
+	expired := current.Add(-o.config.IdempotencyTTL)
+
+	o.keysMutex.Lock()
+	purge := current.Sub(o.keysPurgedAt) >= idempotencyPurgeInterval
+	if purge {
+		o.keysPurgedAt = current
+	}
+	o.keysMutex.Unlock()
+	if purge {
+		if err := o.store.DeleteIdempotencyKeys(expired); err != nil {
+			log.Printf("Could not delete expired idempotency keys: %v\n", err)
+		}
+	}
+
+	stored, err := o.store.GetIdempotencyKey(key)
+	if errors.Is(err, errors.ErrIdempotencyKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored.CreatedAt.Before(expired) {
+		return nil, nil
+	}
+	return stored, nil
+}
+
+// requestHash — SHA-256 пути и тела запроса.
+func requestHash(path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(path))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// crockford — алфавит base32 Крокфорда, которым записываются ULID.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newID возвращает ULID для нового выражения или пакета: 48 бит времени в
+// миллисекундах и 80 случайных бит. Идентификаторы не совпадают даже у
+// запросов, пришедших одновременно, и сортируются по времени создания.
+func newID() string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic(err)
+	}
+
+	// 128 бит записываются 26 символами по 5 бит, старший символ неполный.
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
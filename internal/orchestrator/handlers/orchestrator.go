@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/storage"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Orchestrator принимает выражения, разбивает их на задачи и раздаёт задачи
+// агентам. Каждый экземпляр владеет своим хранилищем и планировщиком, поэтому
+// в одном процессе их может работать несколько.
+type Orchestrator struct {
+	config    Config
+	store     storage.Store
+	scheduler *scheduler
+	agents    map[string]*agentState
+	events    *eventHub
+	results   *resultCache
+	// webhookClient отправляет уведомления на callback_url.
+	webhookClient *http.Client
+	mutex         sync.Mutex
+	// keysMutex защищает keyLocks и keysPurgedAt. keyLocks — блокировки
+	// ключей Idempotency-Key, запросы с которыми сейчас выполняются,
+	// keysPurgedAt — время последней очистки истёкших ключей.
+	keysMutex    sync.Mutex
+	keyLocks     map[string]*keyLock
+	keysPurgedAt time.Time
+}
+
+// NewOrchestrator создаёт оркестратор поверх хранилища и возобновляет
+// сохранённые в нём незавершённые выражения.
+func NewOrchestrator(store storage.Store, config Config) (*Orchestrator, error) {
+	o := &Orchestrator{
+		config:        config,
+		store:         store,
+		scheduler:     newScheduler(config.LeaseGrace),
+		agents:        make(map[string]*agentState),
+		events:        newEventHub(),
+		results:       newResultCache(config.ResultCacheSize, config.ResultCacheTTL),
+		keyLocks:      make(map[string]*keyLock),
+		webhookClient: newWebhookClient(config),
+	}
+	if err := o.restore(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Handler возвращает обработчик со всеми маршрутами оркестратора.
+func (o *Orchestrator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/calculate", o.HandleCalculate)
+	mux.HandleFunc("/api/v1/calculate/batch", o.HandleCalculateBatch)
+	mux.HandleFunc("/api/v1/calculate/plan", o.HandleCalculatePlan)
+	mux.HandleFunc("/api/v1/batches/", o.HandleGetBatch)
+	mux.HandleFunc("/api/v1/expressions", o.HandleGetExpressions)
+	mux.HandleFunc("/api/v1/expressions/", o.HandleExpression)
+	mux.HandleFunc("/api/v1/agents", o.HandleGetAgents)
+	mux.HandleFunc("/internal/task", o.HandleTask)
+	mux.HandleFunc("/internal/agents", o.HandleRegisterAgent)
+	mux.HandleFunc("/internal/agents/", o.HandleAgentHeartbeat)
+	return mux
+}
+
+// restore возвращает в граф оставшиеся задачи незавершённых выражений;
+// выданные до перезапуска аренды сбрасываются.
+func (o *Orchestrator) restore() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	exprs, err := o.store.ListExpressions()
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]*models.Expression)
+	for _, expr := range exprs {
+		if expr.Status == models.StatusPending {
+			pending[expr.ID] = expr
+		}
+	}
+
+	stored, err := o.store.ListTasks()
+	if err != nil {
+		return err
+	}
+	var stale []string
+	var list []*models.Task
+	hasRoot := make(map[string]bool)
+	for _, task := range stored {
+		expr, exists := pending[task.ExpressionID]
+		if !exists {
+			stale = append(stale, task.ID)
+			continue
+		}
+		if task.ID == expr.RootTaskID {
+			hasRoot[expr.ID] = true
+		}
+		task.LeaseID = ""
+		task.Done = make(chan bool)
+		list = append(list, task)
+	}
+	if err := o.store.DeleteTasks(stale...); err != nil {
+		return err
+	}
+
+	// Без корневой задачи результат выражения уже не получить.
+	for id, expr := range pending {
+		if hasRoot[id] {
+			continue
+		}
+		expr.Finish(models.StatusError, o.scheduler.now())
+		expr.Error = "expression tasks were lost"
+		if err := o.store.SaveExpression(expr); err != nil {
+			return err
+		}
+	}
+
+	// Уведомления, которые не успели доставить до перезапуска, доставляются заново.
+	for _, expr := range exprs {
+		if expr.Callback != nil && expr.Callback.Status == models.CallbackPending {
+			go o.deliverCallback(*expr)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	o.scheduler.addTasks(list)
+	log.Printf("Restored %d pending expressions with %d tasks\n", len(hasRoot), len(list))
+
+	return nil
+}
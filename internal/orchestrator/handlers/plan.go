@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/calculator"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"net/http"
+)
+
+// planExpressionID — идентификатор выражения в задачах плана.
+const planExpressionID = "plan"
+
+// expressionPlan — то, как оркестратор вычислил бы выражение: упрощённая
+// запись, сделанные упрощения и задачи, которые получили бы агенты.
+type expressionPlan struct {
+	Expression string               `json:"expression"`
+	Optimized  string               `json:"optimized"`
+	Rewrites   []calculator.Rewrite `json:"rewrites"`
+	Tasks      []*models.Task       `json:"tasks"`
+	// Result заполнен, если выражение вычисляется без задач.
+	Result               *float64 `json:"result,omitempty"`
+	CacheHits            int      `json:"cache_hits"`
+	SharedSubexpressions int      `json:"shared_subexpressions"`
+}
+
+// HandleCalculatePlan принимает то же тело, что и POST /api/v1/calculate, и
+// возвращает план вычисления, ничего не сохраняя и не ставя в очередь.
+func (o *Orchestrator) HandleCalculatePlan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var req calculateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errors.ErrInvalidRequest, err))
+		return
+	}
+
+	s, root, err := o.splitExpression(req.Expression, req.Variables, planExpressionID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	plan := &expressionPlan{
+		Expression:           req.Expression,
+		Optimized:            calculator.Format(s.optimized),
+		Rewrites:             s.rewrites,
+		Tasks:                s.tasks,
+		CacheHits:            s.cacheHits,
+		SharedSubexpressions: s.sharedSubexpressions,
+	}
+	if plan.Rewrites == nil {
+		plan.Rewrites = []calculator.Rewrite{}
+	}
+	if plan.Tasks == nil {
+		plan.Tasks = []*models.Task{}
+	}
+	if root.TaskID == "" {
+		plan.Result = &root.Value
+	}
+
+	writeJSON(w, http.StatusOK, map[string]*expressionPlan{"plan": plan})
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultLimit — размер страницы списка выражений, если limit не задан.
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// expressionQuery — параметры запроса GET /api/v1/expressions.
+type expressionQuery struct {
+	limit    int
+	cursor   *expressionCursor
+	statuses map[string]bool
+	// createdAfter включительно, createdBefore — нет; нулевое время
+	// означает отсутствие границы.
+	createdAfter  time.Time
+	createdBefore time.Time
+	descending    bool
+}
+
+// expressionCursor указывает на последнее выражение выданной страницы.
+// Выражения упорядочены по времени создания, при равенстве — по ID.
+type expressionCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+func parseExpressionQuery(values url.Values) (expressionQuery, error) {
+	query := expressionQuery{limit: defaultLimit}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("%w: invalid limit %q", errors.ErrInvalidRequest, value)
+		}
+		query.limit = min(limit, maxLimit)
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil {
+			return query, err
+		}
+		query.cursor = cursor
+	}
+
+	for _, value := range values["status"] {
+		for _, status := range strings.Split(value, ",") {
+			switch status {
+			case models.StatusPending, models.StatusDone, models.StatusError, models.StatusCancelled:
+			default:
+				return query, fmt.Errorf("%w: invalid status %q", errors.ErrInvalidRequest, status)
+			}
+			if query.statuses == nil {
+				query.statuses = make(map[string]bool)
+			}
+			query.statuses[status] = true
+		}
+	}
+
+	var err error
+	if query.createdAfter, err = parseTime(values, "created_after"); err != nil {
+		return query, err
+	}
+	if query.createdBefore, err = parseTime(values, "created_before"); err != nil {
+		return query, err
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.descending = true
+	default:
+		return query, fmt.Errorf("%w: invalid order %q", errors.ErrInvalidRequest, order)
+	}
+
+	return query, nil
+}
+
+// parseTime разбирает время в формате RFC 3339; пустое значение — нулевое время.
+func parseTime(values url.Values, name string) (time.Time, error) {
+	value := values.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid %s %q", errors.ErrInvalidRequest, name, value)
+	}
+	return t, nil
+}
+
+// page фильтрует и упорядочивает выражения и возвращает одну страницу и
+// курсор следующей; курсор пуст, если страница последняя.
+func (q expressionQuery) page(exprs []*models.Expression) ([]models.Expression, string) {
+	sort.Slice(exprs, func(i, j int) bool {
+		if q.descending {
+			return exprBefore(exprs[j], exprs[i])
+		}
+		return exprBefore(exprs[i], exprs[j])
+	})
+
+	page := make([]models.Expression, 0, min(q.limit, len(exprs)))
+	for _, expr := range exprs {
+		if !q.matches(expr) {
+			continue
+		}
+		if len(page) == q.limit {
+			last := page[len(page)-1]
+			return page, encodeCursor(expressionCursor{createdAt: last.CreatedAt, id: last.ID})
+		}
+		page = append(page, *expr)
+	}
+	return page, ""
+}
+
+func (q expressionQuery) matches(expr *models.Expression) bool {
+	if q.statuses != nil && !q.statuses[expr.Status] {
+		return false
+	}
+	if !q.createdAfter.IsZero() && expr.CreatedAt.Before(q.createdAfter) {
+		return false
+	}
+	if !q.createdBefore.IsZero() && !expr.CreatedAt.Before(q.createdBefore) {
+		return false
+	}
+	if q.cursor != nil {
+		// Выражения до курсора включительно уже выданы.
+		at := &models.Expression{ID: q.cursor.id, CreatedAt: q.cursor.createdAt}
+		if q.descending {
+			return exprBefore(expr, at)
+		}
+		return exprBefore(at, expr)
+	}
+	return true
+}
+
+// exprBefore сообщает, отправлено ли выражение a раньше b.
+func exprBefore(a, b *models.Expression) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
+
+// encodeCursor кодирует курсор как "<время в наносекундах>:<ID>" в base64,
+// чтобы клиенты не разбирали его сами. У выражений, сохранённых до появления
+// created_at, время пустое.
+func encodeCursor(cursor expressionCursor) string {
+	nanos := ""
+	if !cursor.createdAt.IsZero() {
+		nanos = strconv.FormatInt(cursor.createdAt.UnixNano(), 10)
+	}
+	raw := nanos + ":" + cursor.id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (*expressionCursor, error) {
+	invalid := fmt.Errorf("%w: invalid cursor %q", errors.ErrInvalidRequest, value)
+
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, invalid
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return nil, invalid
+	}
+	cursor := &expressionCursor{id: id}
+	if nanos != "" {
+		unixNano, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		cursor.createdAt = time.Unix(0, unixNano)
+	}
+	return cursor, nil
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errorResponse — тело ответа с ошибкой. Code стабилен и не зависит от текста
+// сообщения, Details содержит подробности, например позицию ошибки в выражении.
+type errorResponse struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// writeJSON кодирует ответ до отправки заголовков: если v не кодируется,
+// клиент получает 500 с ошибкой вместо пустого ответа со статусом status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Could not encode response: %v\n", err)
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(&errorResponse{Code: errors.Code(err), Message: "could not encode response"})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// writeError отвечает ошибкой в едином формате; HTTP-статус выбирается по
+// ошибке из pkg/errors, которую оборачивает err.
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, errorStatus(err), newErrorResponse(err))
+}
+
+func newErrorResponse(err error) *errorResponse {
+	response := &errorResponse{
+		Code:    errors.Code(err),
+		Message: err.Error(),
+	}
+
+	var parseErr *errors.ParseError
+	if errors.As(err, &parseErr) {
+		response.Details = map[string]any{
+			"offset":   parseErr.Offset,
+			"token":    parseErr.Token,
+			"expected": parseErr.Expected,
+		}
+	}
+
+	return response
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errors.ErrInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, errors.ErrExpressionNotFound),
+		errors.Is(err, errors.ErrTaskNotFound),
+		errors.Is(err, errors.ErrNoTasksAvailable),
+		errors.Is(err, errors.ErrAgentNotFound),
+		errors.Is(err, errors.ErrBatchNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errors.ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errors.ErrLeaseExpired),
+		errors.Is(err, errors.ErrExpressionFinished):
+		return http.StatusConflict
+	case errors.Is(err, errors.ErrRequestTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Code(err) != "internal_error":
+		// Остальные известные ошибки относятся к самому выражению: запрос
+		// корректен, но вычислить его нельзя.
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// allowMethods отвечает 405, если метод запроса не входит в methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, errors.ErrMethodNotAllowed)
+	return false
+}
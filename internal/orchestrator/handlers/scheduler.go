@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"log"
+	"time"
+)
+
+// scheduler хранит граф зависимостей незавершённых задач. Задача попадает в
+// очередь готовых только после того, как все её родительские задачи вернули
+// результат. Независимые ветви выражения, например обе части (a+b)*(c+d),
+// оказываются в очереди одновременно и могут быть выданы разным агентам.
+//
+// Выданная задача переходит в inFlight с арендой: если агент не вернул
+// результат до истечения срока, задача возвращается в очередь и выдаётся
+// заново с новым идентификатором аренды, а ответ прежнего агента отклоняется.
+//
+// Методы scheduler не синхронизированы и вызываются под мьютексом оркестратора.
+
+// appliedLeaseTTL — сколько помнятся аренды, ответ по которым уже принят:
+// повтор ответа в этот срок подтверждается, а не отклоняется.
+const appliedLeaseTTL = time.Minute
+
+type scheduler struct {
+	tasks       map[string]*models.Task
+	dependents  map[string][]string
+	pendingDeps map[string]int
+	readyQueue  []string
+	inFlight    map[string]time.Time
+	leaseGrace  time.Duration
+
+	// applied — принятые аренды по их идентификатору; appliedPurgedAt — когда
+	// из applied в последний раз удалялись устаревшие записи.
+	applied         map[string]appliedLease
+	appliedPurgedAt time.Time
+
+	// waiters — получатели, ждущие задачу, в порядке ожидания.
+	waiters []chan struct{}
+
+	// now подменяется в тестах.
+	now func() time.Time
+}
+
+func newScheduler(leaseGrace time.Duration) *scheduler {
+	return &scheduler{
+		tasks:       make(map[string]*models.Task),
+		dependents:  make(map[string][]string),
+		pendingDeps: make(map[string]int),
+		inFlight:    make(map[string]time.Time),
+		leaseGrace:  leaseGrace,
+		applied:     make(map[string]appliedLease),
+		now:         time.Now,
+	}
+}
+
+// appliedLease — задача, ответ по аренде которой принят, и время приёма.
+type appliedLease struct {
+	taskID string
+	at     time.Time
+}
+
+// addTasks регистрирует задачи выражения в графе и ставит в очередь те,
+// у которых нет незавершённых зависимостей.
+func (s *scheduler) addTasks(list []*models.Task) {
+	for _, task := range list {
+		s.tasks[task.ID] = task
+	}
+
+	for _, task := range list {
+		s.pendingDeps[task.ID] = 0
+		for _, dep := range task.Dependencies {
+			if _, exists := s.tasks[dep]; !exists {
+				continue
+			}
+			s.dependents[dep] = append(s.dependents[dep], task.ID)
+			s.pendingDeps[task.ID]++
+		}
+		if s.pendingDeps[task.ID] == 0 {
+			s.enqueue(task.ID)
+		}
+	}
+}
+
+// enqueue ставит задачу в очередь готовых и будит одного ждущего получателя:
+// на одну задачу приходится ровно одно пробуждение.
+func (s *scheduler) enqueue(id string) {
+	s.readyQueue = append(s.readyQueue, id)
+	s.wakeOne()
+}
+
+// addWaiter регистрирует получателя, ждущего задачу. В возвращённый канал
+// придёт сигнал, когда в очереди появится задача.
+func (s *scheduler) addWaiter() chan struct{} {
+	wake := make(chan struct{}, 1)
+	s.waiters = append(s.waiters, wake)
+	return wake
+}
+
+// removeWaiter снимает получателя с ожидания и сообщает, успел ли он
+// получить сигнал.
+func (s *scheduler) removeWaiter(wake chan struct{}) bool {
+	for i, w := range s.waiters {
+		if w == wake {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			break
+		}
+	}
+	return len(wake) > 0
+}
+
+func (s *scheduler) wakeOne() {
+	if len(s.waiters) == 0 {
+		return
+	}
+	wake := s.waiters[0]
+	s.waiters = s.waiters[1:]
+	wake <- struct{}{}
+}
+
+// nextMatchingTask выдаёт аренду на первую в порядке постановки в очередь
+// готовую задачу, которую принимает accept, или возвращает nil, если таких
+// нет; остальные задачи остаются в очереди на своих местах. nil принимает
+// любую задачу.
+func (s *scheduler) nextMatchingTask(accept func(*models.Task) bool) *models.Task {
+	s.requeueExpiredLeases()
+
+	kept := s.readyQueue[:0]
+	var found *models.Task
+	for i, id := range s.readyQueue {
+		task, exists := s.tasks[id]
+		if !exists {
+			continue
+		}
+		if _, leased := s.inFlight[id]; leased {
+			continue
+		}
+		if accept != nil && !accept(task) {
+			kept = append(kept, id)
+			continue
+		}
+
+		found = task
+		kept = append(kept, s.readyQueue[i+1:]...)
+		break
+	}
+	s.readyQueue = kept
+	if found == nil {
+		return nil
+	}
+
+	found.LeaseID = newLeaseID()
+	s.inFlight[found.ID] = s.now().Add(s.leaseDuration(found))
+	return found
+}
+
+// requeueExpiredLeases возвращает в очередь задачи, аренда которых истекла.
+func (s *scheduler) requeueExpiredLeases() {
+	current := s.now()
+	for id, deadline := range s.inFlight {
+		if current.Before(deadline) {
+			continue
+		}
+		delete(s.inFlight, id)
+
+		if task, exists := s.tasks[id]; exists {
+			log.Printf("Lease %s of task %s expired, requeueing\n", task.LeaseID, id)
+			task.LeaseID = ""
+			s.enqueue(id)
+		}
+	}
+}
+
+// releaseTask снимает аренду с задачи, от которой отказался агент, и сразу
+// возвращает её в очередь, не дожидаясь истечения срока.
+func (s *scheduler) releaseTask(taskID string) {
+	task, exists := s.tasks[taskID]
+	if !exists {
+		return
+	}
+	delete(s.inFlight, taskID)
+	task.LeaseID = ""
+	s.enqueue(taskID)
+}
+
+// checkLease сообщает, держит ли агент с leaseID действующую аренду задачи.
+// Истёкшая аренда недействительна, даже если задачу ещё не выдали заново.
+func (s *scheduler) checkLease(task *models.Task, leaseID string) bool {
+	deadline, leased := s.inFlight[task.ID]
+	return leased && s.now().Before(deadline) && task.LeaseID != "" && task.LeaseID == leaseID
+}
+
+// markApplied запоминает, что ответ по аренде leaseID принят.
+func (s *scheduler) markApplied(taskID, leaseID string) {
+	current := s.now()
+	if current.Sub(s.appliedPurgedAt) >= appliedLeaseTTL {
+		for id, lease := range s.applied {
+			if current.Sub(lease.at) >= appliedLeaseTTL {
+				delete(s.applied, id)
+			}
+		}
+		s.appliedPurgedAt = current
+	}
+	s.applied[leaseID] = appliedLease{taskID: taskID, at: current}
+}
+
+// wasApplied сообщает, принят ли уже ответ по аренде leaseID задачи taskID.
+func (s *scheduler) wasApplied(taskID, leaseID string) bool {
+	lease, exists := s.applied[leaseID]
+	return exists && lease.taskID == taskID && s.now().Sub(lease.at) < appliedLeaseTTL
+}
+
+// leaseDuration — срок аренды: время операции плюс запас на сеть и
+// планирование агента.
+func (s *scheduler) leaseDuration(task *models.Task) time.Duration {
+	return task.OperationTime + s.leaseGrace
+}
+
+func newLeaseID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// updateTaskArgs подставляет результат задачи в те аргументы дочерних задач,
+// которые ссылаются именно на неё, и возвращает изменённые задачи.
+func (s *scheduler) updateTaskArgs(taskID string, result float64) []*models.Task {
+	var updated []*models.Task
+	for _, childID := range s.dependents[taskID] {
+		child, exists := s.tasks[childID]
+		if !exists {
+			continue
+		}
+		for i := range child.Operands {
+			if child.Operands[i].TaskID == taskID {
+				child.Operands[i].Value = result
+			}
+		}
+		child.SyncArgs()
+		updated = append(updated, child)
+	}
+	return updated
+}
+
+// completeTask удаляет выполненную задачу из графа и переводит в очередь
+// готовых дочерние задачи, у которых не осталось незавершённых зависимостей.
+func (s *scheduler) completeTask(taskID string) {
+	delete(s.tasks, taskID)
+	delete(s.inFlight, taskID)
+	delete(s.pendingDeps, taskID)
+
+	for _, childID := range s.dependents[taskID] {
+		if _, exists := s.tasks[childID]; !exists {
+			continue
+		}
+		s.pendingDeps[childID]--
+		if s.pendingDeps[childID] == 0 {
+			s.enqueue(childID)
+		}
+	}
+	delete(s.dependents, taskID)
+}
+
+// cancelExpressionTasks убирает из графа все оставшиеся задачи выражения:
+// и ожидающие, и уже выданные агентам. Возвращает идентификаторы удалённых задач.
+func (s *scheduler) cancelExpressionTasks(exprID string) []string {
+	var removed []string
+	for id, task := range s.tasks {
+		if task.ExpressionID == exprID {
+			delete(s.tasks, id)
+			delete(s.dependents, id)
+			delete(s.inFlight, id)
+			delete(s.pendingDeps, id)
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
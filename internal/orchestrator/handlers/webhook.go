@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// webhookEvent — тип уведомления, он же заголовок X-Calculator-Event.
+	webhookEvent = "expression.finished"
+	// signatureHeader содержит "sha256=" и HMAC-SHA256 тела запроса в hex.
+	signatureHeader = "X-Calculator-Signature"
+)
+
+// newWebhookClient создаёт клиент уведомлений, который соединяется только с
+// разрешёнными адресами. Проверяется адрес, с которым действительно
+// устанавливается соединение, поэтому её не обойти ни именем, указывающим
+// на внутренний адрес, ни перенаправлением.
+func newWebhookClient(config Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !config.callbackAddrAllowed(addr.Addr()) {
+				return fmt.Errorf("callback address %s is not allowed", addr.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Через прокси проверялся бы адрес прокси, а не получателя.
+	transport.Proxy = nil
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// callbackAddrAllowed сообщает, можно ли отправлять уведомления на адрес:
+// внутренние адреса разрешены только из WebhookAllowedNetworks.
+func (c Config) callbackAddrAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range c.WebhookAllowedNetworks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() &&
+		!addr.IsUnspecified() && !addr.IsMulticast() && !addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast()
+}
+
+// validateCallbackURL проверяет, что callback_url — абсолютный адрес http(s)
+// и не указывает на запрещённый адрес. Имена, кроме localhost, здесь не
+// разрешаются: их адрес проверяется при соединении.
+func (o *Orchestrator) validateCallbackURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: callback_url must be an absolute http or https URL", errors.ErrInvalidRequest)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	addr, err := netip.ParseAddr(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		addr, err = netip.IPv6Loopback(), nil
+	}
+	if err == nil && !o.config.callbackAddrAllowed(addr) {
+		return fmt.Errorf("%w: callback_url must not point to an internal address", errors.ErrInvalidRequest)
+	}
+	return nil
+}
+
+// expressionFinished сообщает о завершении выражения подписчикам потока
+// событий и запускает доставку уведомления на callback_url. Вызывается под
+// мьютексом после сохранения выражения.
+func (o *Orchestrator) expressionFinished(expr *models.Expression) {
+	o.publishResult(expr)
+	if expr.Callback != nil && expr.Callback.Status == models.CallbackPending {
+		go o.deliverCallback(*expr)
+	}
+}
+
+// deliverCallback отправляет уведомление, пока получатель не ответит 2xx или
+// не кончатся попытки; между попытками пауза растёт вдвое, но не больше
+// WebhookMaxBackoff. После перезапуска
+// доставка продолжается с сохранённого числа попыток.
+func (o *Orchestrator) deliverCallback(expr models.Expression) {
+	attempts := expr.Callback.Attempts
+	expr.Callback = nil
+	payload, err := json.Marshal(map[string]any{"event": webhookEvent, "expression": expr})
+	if err != nil {
+		log.Printf("Could not marshal callback for expression %s: %v\n", expr.ID, err)
+		return
+	}
+
+	for {
+		if attempts > 0 {
+			time.Sleep(o.callbackDelay(attempts))
+		}
+		attempts++
+
+		err := o.postCallback(expr.CallbackURL, payload)
+		if err != nil {
+			log.Printf("Callback for expression %s failed (attempt %d): %v\n", expr.ID, attempts, err)
+		}
+		if !o.recordCallback(expr.ID, attempts, err) {
+			return
+		}
+	}
+}
+
+// callbackDelay возвращает паузу после attempts неудачных попыток. Пауза
+// удваивается, пока не достигнет предела, поэтому большое число попыток,
+// сохранённое до перезапуска, не переполняет time.Duration.
+func (o *Orchestrator) callbackDelay(attempts int) time.Duration {
+	delay, limit := o.config.WebhookBackoff, o.config.WebhookMaxBackoff
+	for i := 1; i < attempts && delay > 0 && delay < limit; i++ {
+		if delay > limit/2 {
+			return limit
+		}
+		delay *= 2
+	}
+	return max(min(delay, limit), 0)
+}
+
+func (o *Orchestrator) postCallback(callbackURL string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Calculator-Event", webhookEvent)
+	if o.config.WebhookSecret != "" {
+		req.Header.Set(signatureHeader, signPayload(o.config.WebhookSecret, payload))
+	}
+
+	resp, err := o.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordCallback сохраняет результат попытки доставки и сообщает, нужна ли
+// ещё одна.
+func (o *Orchestrator) recordCallback(exprID string, attempts int, deliveryErr error) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	expr, err := o.store.GetExpression(exprID)
+	if err != nil || expr.Callback == nil {
+		return false
+	}
+
+	// Состояние заменяется целиком: прочитанные ранее копии выражения могут
+	// ссылаться на прежнее.
+	current := o.scheduler.now()
+	callback := *expr.Callback
+	expr.Callback = &callback
+	callback.Attempts = attempts
+	callback.LastAttemptAt = &current
+	switch {
+	case deliveryErr == nil:
+		callback.Status = models.CallbackDelivered
+		callback.DeliveredAt = &current
+		callback.LastError = ""
+	case attempts >= o.config.WebhookAttempts:
+		callback.Status = models.CallbackFailed
+		callback.LastError = deliveryErr.Error()
+	default:
+		callback.LastError = deliveryErr.Error()
+	}
+
+	if err := o.store.SaveExpression(expr); err != nil {
+		log.Printf("Could not save callback status of expression %s: %v\n", exprID, err)
+	}
+	return callback.Status == models.CallbackPending
+}
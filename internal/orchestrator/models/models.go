@@ -0,0 +1,152 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusError   = "error"
+	// StatusCancelled — выражение отменено клиентом до завершения.
+	StatusCancelled = "cancelled"
+)
+
+// Статусы доставки уведомления на callback_url.
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+const (
+	AgentHealthy   = "healthy"
+	AgentUnhealthy = "unhealthy"
+)
+
+type Expression struct {
+	ID         string             `json:"id"`
+	Expr       string             `json:"expression"`
+	Variables  map[string]float64 `json:"variables,omitempty"`
+	Status     string             `json:"status"`
+	Result     float64            `json:"result"`
+	Error      string             `json:"error,omitempty"`
+	RootTaskID string             `json:"root_task_id,omitempty"`
+	CreatedAt  time.Time          `json:"created_at"`
+	// FinishedAt — время перехода в done, error или cancelled.
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// BatchID и Label заполнены у выражений, отправленных пакетом.
+	BatchID string `json:"batch_id,omitempty"`
+	Label   string `json:"label,omitempty"`
+	// CallbackURL — адрес, на который отправляется уведомление о завершении.
+	CallbackURL string    `json:"callback_url,omitempty"`
+	Callback    *Callback `json:"callback,omitempty"`
+	// CacheHits — сколько подвыражений взято из кэша результатов, а
+	// SharedSubexpressions — сколько повторов подвыражений внутри выражения
+	// вычислены одной задачей.
+	CacheHits            int `json:"cache_hits"`
+	SharedSubexpressions int `json:"shared_subexpressions"`
+}
+
+// Callback — состояние доставки уведомления о завершении выражения.
+type Callback struct {
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Finish переводит выражение в завершённый статус и запоминает время. Если
+// у выражения есть callback_url, уведомление ставится в очередь на доставку.
+func (e *Expression) Finish(status string, at time.Time) {
+	e.Status = status
+	e.FinishedAt = &at
+	if e.CallbackURL != "" {
+		e.Callback = &Callback{Status: CallbackPending}
+	}
+}
+
+// Batch — пакет выражений, отправленных одним запросом. Статус пакета не
+// хранится, а вычисляется по статусам выражений.
+type Batch struct {
+	ID        string      `json:"id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Items     []BatchItem `json:"items"`
+}
+
+// BatchItem — элемент пакета: принятое выражение или причина, по которой
+// оно отклонено.
+type BatchItem struct {
+	Label        string `json:"label,omitempty"`
+	ExpressionID string `json:"expression_id,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// IdempotencyKey — ответ на запрос с заголовком Idempotency-Key. Повторный
+// запрос с тем же ключом получает этот ответ вместо нового выражения.
+type IdempotencyKey struct {
+	Key string `json:"key"`
+	// RequestHash — SHA-256 пути и тела запроса: с тем же ключом нельзя
+	// отправить другой запрос.
+	RequestHash string          `json:"request_hash"`
+	StatusCode  int             `json:"status_code"`
+	Response    json.RawMessage `json:"response"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Operand — аргумент задачи: либо число из выражения, либо результат другой
+// задачи того же выражения.
+type Operand struct {
+	Value  float64 `json:"value"`
+	TaskID string  `json:"task_id,omitempty"`
+}
+
+type Task struct {
+	ID            string        `json:"id"`
+	Arg1          float64       `json:"arg1"`
+	Arg2          float64       `json:"arg2"`
+	Args          []float64     `json:"args,omitempty"`
+	Operation     string        `json:"operation"`
+	OperationTime time.Duration `json:"operation_time"`
+	ExpressionID  string        `json:"expression_id"`
+	Priority      int           `json:"priority"`
+	Operands      []Operand     `json:"operands"`
+	Dependencies  []string      `json:"dependencies,omitempty"`
+	// Key — ключ подвыражения задачи, под которым результат попадает в кэш.
+	Key     string    `json:"key,omitempty"`
+	LeaseID string    `json:"lease_id,omitempty"`
+	Done    chan bool `json:"-"`
+}
+
+// SyncArgs переносит значения аргументов в поля Arg1, Arg2 и Args, которые читает агент.
+func (t *Task) SyncArgs() {
+	t.Args = make([]float64, len(t.Operands))
+	for i, operand := range t.Operands {
+		t.Args[i] = operand.Value
+	}
+	if len(t.Operands) > 0 {
+		t.Arg1 = t.Operands[0].Value
+	}
+	if len(t.Operands) > 1 {
+		t.Arg2 = t.Operands[1].Value
+	}
+}
+
+// Agent — зарегистрированный агент в списке GET /api/v1/agents.
+type Agent struct {
+	ID         string   `json:"id"`
+	Capacity   int      `json:"capacity"`
+	Operations []string `json:"operations,omitempty"`
+	// Status — healthy, пока агент вовремя присылает сигналы, иначе unhealthy.
+	Status         string    `json:"status"`
+	RegisteredAt   time.Time `json:"registered_at"`
+	LastHeartbeat  time.Time `json:"last_heartbeat"`
+	CurrentTasks   []string  `json:"current_tasks"`
+	CompletedTasks int       `json:"completed_tasks"`
+	FailedTasks    int       `json:"failed_tasks"`
+	// TasksPerMinute — число задач, завершённых агентом за последнюю минуту.
+	TasksPerMinute int `json:"tasks_per_minute"`
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	expressionsBucket = []byte("expressions")
+	batchesBucket     = []byte("batches")
+	idempotencyBucket = []byte("idempotency_keys")
+	tasksBucket       = []byte("tasks")
+)
+
+// BoltStore хранит выражения и задачи во встроенной базе bbolt, поэтому они
+// переживают перезапуск оркестратора. Записи хранятся в JSON.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{expressionsBucket, batchesBucket, idempotencyBucket, tasksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) SaveExpression(expr *models.Expression) error {
+	data, err := json.Marshal(expr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal expression: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(expressionsBucket).Put([]byte(expr.ID), data)
+	})
+}
+
+func (s *BoltStore) GetExpression(id string) (*models.Expression, error) {
+	var expr *models.Expression
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(expressionsBucket).Get([]byte(id))
+		if data == nil {
+			return errors.ErrExpressionNotFound
+		}
+		expr = &models.Expression{}
+		return json.Unmarshal(data, expr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expr, nil
+}
+
+func (s *BoltStore) ListExpressions() ([]*models.Expression, error) {
+	var exprs []*models.Expression
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(expressionsBucket).ForEach(func(_, data []byte) error {
+			expr := &models.Expression{}
+			if err := json.Unmarshal(data, expr); err != nil {
+				return err
+			}
+			exprs = append(exprs, expr)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return exprs, nil
+}
+
+func (s *BoltStore) SaveBatch(batch *models.Batch) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(batchesBucket).Put([]byte(batch.ID), data)
+	})
+}
+
+func (s *BoltStore) GetBatch(id string) (*models.Batch, error) {
+	var batch *models.Batch
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(batchesBucket).Get([]byte(id))
+		if data == nil {
+			return errors.ErrBatchNotFound
+		}
+		batch = &models.Batch{}
+		return json.Unmarshal(data, batch)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+func (s *BoltStore) SaveIdempotencyKey(key *models.IdempotencyKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency key: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(idempotencyBucket).Put([]byte(key.Key), data)
+	})
+}
+
+func (s *BoltStore) GetIdempotencyKey(key string) (*models.IdempotencyKey, error) {
+	var stored *models.IdempotencyKey
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(idempotencyBucket).Get([]byte(key))
+		if data == nil {
+			return errors.ErrIdempotencyKeyNotFound
+		}
+		stored = &models.IdempotencyKey{}
+		return json.Unmarshal(data, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+func (s *BoltStore) DeleteIdempotencyKeys(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(k, data []byte) error {
+			var key models.IdempotencyKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return err
+			}
+			if key.CreatedAt.Before(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) SaveTasks(tasks ...*models.Task) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		for _, task := range tasks {
+			data, err := json.Marshal(task)
+			if err != nil {
+				return fmt.Errorf("failed to marshal task: %w", err)
+			}
+			if err := bucket.Put([]byte(task.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) DeleteTasks(ids ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		for _, id := range ids {
+			if err := bucket.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) ListTasks() ([]*models.Task, error) {
+	var tasks []*models.Task
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).ForEach(func(_, data []byte) error {
+			task := &models.Task{}
+			if err := json.Unmarshal(data, task); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"sync"
+	"time"
+)
+
+// MemoryStore держит данные в памяти процесса и теряет их при перезапуске.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	expressions map[string]models.Expression
+	batches     map[string]models.Batch
+	keys        map[string]models.IdempotencyKey
+	tasks       map[string]models.Task
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		expressions: make(map[string]models.Expression),
+		batches:     make(map[string]models.Batch),
+		keys:        make(map[string]models.IdempotencyKey),
+		tasks:       make(map[string]models.Task),
+	}
+}
+
+func (s *MemoryStore) SaveExpression(expr *models.Expression) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expressions[expr.ID] = *expr
+	return nil
+}
+
+func (s *MemoryStore) GetExpression(id string) (*models.Expression, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	expr, exists := s.expressions[id]
+	if !exists {
+		return nil, errors.ErrExpressionNotFound
+	}
+	return &expr, nil
+}
+
+func (s *MemoryStore) ListExpressions() ([]*models.Expression, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	exprs := make([]*models.Expression, 0, len(s.expressions))
+	for _, expr := range s.expressions {
+		expr := expr
+		exprs = append(exprs, &expr)
+	}
+	return exprs, nil
+}
+
+func (s *MemoryStore) SaveBatch(batch *models.Batch) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored := *batch
+	stored.Items = append([]models.BatchItem(nil), batch.Items...)
+	s.batches[batch.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) GetBatch(id string) (*models.Batch, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	batch, exists := s.batches[id]
+	if !exists {
+		return nil, errors.ErrBatchNotFound
+	}
+	batch.Items = append([]models.BatchItem(nil), batch.Items...)
+	return &batch, nil
+}
+
+func (s *MemoryStore) SaveIdempotencyKey(key *models.IdempotencyKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys[key.Key] = *key
+	return nil
+}
+
+func (s *MemoryStore) GetIdempotencyKey(key string) (*models.IdempotencyKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	stored, exists := s.keys[key]
+	if !exists {
+		return nil, errors.ErrIdempotencyKeyNotFound
+	}
+	return &stored, nil
+}
+
+func (s *MemoryStore) DeleteIdempotencyKeys(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for k, key := range s.keys {
+		if key.CreatedAt.Before(before) {
+			delete(s.keys, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveTasks(tasks ...*models.Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, task := range tasks {
+		s.tasks[task.ID] = *task
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteTasks(ids ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range ids {
+		delete(s.tasks, id)
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListTasks() ([]*models.Task, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	tasks := make([]*models.Task, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		task := task
+		tasks = append(tasks, &task)
+	}
+	return tasks, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/InsafMin/web_calculator/internal/orchestrator/models"
+	"time"
+)
+
+// Store хранит выражения и ещё не выполненные задачи. Выполненные задачи из
+// хранилища удаляются: их результаты к этому моменту уже записаны в аргументы
+// дочерних задач или в результат выражения.
+type Store interface {
+	SaveExpression(expr *models.Expression) error
+	// GetExpression возвращает errors.ErrExpressionNotFound, если выражения нет.
+	GetExpression(id string) (*models.Expression, error)
+	ListExpressions() ([]*models.Expression, error)
+
+	SaveBatch(batch *models.Batch) error
+	// GetBatch возвращает errors.ErrBatchNotFound, если пакета нет.
+	GetBatch(id string) (*models.Batch, error)
+
+	SaveIdempotencyKey(key *models.IdempotencyKey) error
+	// GetIdempotencyKey возвращает errors.ErrIdempotencyKeyNotFound, если ключа нет.
+	GetIdempotencyKey(key string) (*models.IdempotencyKey, error)
+	// DeleteIdempotencyKeys удаляет ключи, сохранённые раньше before.
+	DeleteIdempotencyKeys(before time.Time) error
+
+	SaveTasks(tasks ...*models.Task) error
+	DeleteTasks(ids ...string) error
+	ListTasks() ([]*models.Task, error)
+
+	Close() error
+}
+
+// Open открывает хранилище указанного типа: "memory" (по умолчанию) или
+// "bolt" — файл базы bbolt по пути path.
+func Open(kind, path string) (Store, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "bolt":
+		return OpenBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", kind)
+	}
+}
@@ -0,0 +1,5 @@
+// Package workerpb содержит сгенерированный код gRPC-сервиса Worker из
+// api/worker.proto.
+package workerpb
+
+//go:generate protoc -I ../../api --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative worker.proto
@@ -0,0 +1,85 @@
+package calculator
+
+import "github.com/InsafMin/web_calculator/pkg/errors"
+
+// Node — узел синтаксического дерева выражения. Pos — смещение в байтах
+// лексемы, с которой начинается узел (для операций — знака или имени функции).
+type Node interface {
+	Pos() int
+}
+
+// OperationNode — узел, значение которого получается применением операции
+// к значениям аргументов. Operation() совпадает с тем, что принимает Apply.
+type OperationNode interface {
+	Node
+	Operation() string
+	Args() []Node
+}
+
+type NumberNode struct {
+	Value    float64
+	Text     string
+	Position int
+}
+
+// IdentNode — ссылка на переменную или встроенную константу.
+type IdentNode struct {
+	Name     string
+	Position int
+}
+
+type UnaryNode struct {
+	Op       string
+	Operand  Node
+	Position int
+}
+
+type BinaryNode struct {
+	Op       string
+	Left     Node
+	Right    Node
+	Position int
+}
+
+type CallNode struct {
+	Name      string
+	Arguments []Node
+	Position  int
+}
+
+func (n *NumberNode) Pos() int { return n.Position }
+func (n *IdentNode) Pos() int  { return n.Position }
+func (n *UnaryNode) Pos() int  { return n.Position }
+func (n *BinaryNode) Pos() int { return n.Position }
+func (n *CallNode) Pos() int   { return n.Position }
+
+func (n *UnaryNode) Operation() string  { return n.Op }
+func (n *BinaryNode) Operation() string { return n.Op }
+func (n *CallNode) Operation() string   { return n.Name }
+
+func (n *UnaryNode) Args() []Node  { return []Node{n.Operand} }
+func (n *BinaryNode) Args() []Node { return []Node{n.Left, n.Right} }
+func (n *CallNode) Args() []Node   { return n.Arguments }
+
+// Eval вычисляет дерево выражения, беря значения переменных из variables.
+func Eval(node Node, variables map[string]float64) (float64, error) {
+	switch n := node.(type) {
+	case *NumberNode:
+		return n.Value, nil
+	case *IdentNode:
+		return n.Resolve(variables)
+	case OperationNode:
+		args := n.Args()
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			value, err := Eval(arg, variables)
+			if err != nil {
+				return 0, err
+			}
+			values[i] = value
+		}
+		return Apply(n.Operation(), values)
+	default:
+		return 0, errors.ErrInvalidExpression
+	}
+}
@@ -2,26 +2,21 @@ package calculator
 
 import (
 	"github.com/InsafMin/web_calculator/pkg/errors"
-	"strconv"
-	"strings"
-	"unicode"
+	"math"
 )
 
 func Calc(expression string) (float64, error) {
-	expression = strings.Replace(expression, " ", "", -1)
-	if strings.Count(expression, "(") > strings.Count(expression, ")") {
-		return 0, errors.ErrExtraOpenBracket
-	}
-	if strings.Count(expression, "(") < strings.Count(expression, ")") {
-		return 0, errors.ErrExtraCloseBracket
-	}
+	return CalcWithVariables(expression, nil)
+}
 
-	tokens, err := Tokenize(expression)
+// CalcWithVariables вычисляет выражение, подставляя значения переменных по имени.
+func CalcWithVariables(expression string, variables map[string]float64) (float64, error) {
+	node, err := Parse(expression)
 	if err != nil {
 		return 0, err
 	}
 
-	result, err := Evaluate(tokens)
+	result, err := Eval(node, variables)
 	if err != nil {
 		return 0, err
 	}
@@ -29,37 +24,35 @@ func Calc(expression string) (float64, error) {
 	return result, nil
 }
 
-func Tokenize(expression string) ([]string, error) {
-	expression = strings.ReplaceAll(expression, " ", "")
-	var tokens []string
-	var number string
+func IsOperator(r rune) bool {
+	return r == '+' || r == '-' || r == '*' || r == '/' || r == '^' || r == '%'
+}
 
-	for _, r := range expression {
-		if unicode.IsDigit(r) || r == '.' {
-			number += string(r)
-		} else if IsOperator(r) || r == '(' || r == ')' {
-			if number != "" {
-				tokens = append(tokens, number)
-				number = ""
-			}
-			tokens = append(tokens, string(r))
-		} else {
-			return nil, errors.ErrUnacceptableSymbol
-		}
-	}
+func IsUnary(token string) bool {
+	return token == Negation
+}
 
-	if number != "" {
-		tokens = append(tokens, number)
+func ResolveUnary(a float64, operator string) (float64, error) {
+	switch operator {
+	case Negation:
+		return -a, nil
+	default:
+		return 0, errors.ErrOperatorNotSupported
 	}
-
-	return tokens, nil
 }
 
-func IsOperator(r rune) bool {
-	return r == '+' || r == '-' || r == '*' || r == '/'
+// Resolve применяет бинарный оператор. Бесконечность и NaN, например
+// при 2 ^ 2000 или (-8) ^ 0.5, считаются ошибкой ErrNonFiniteResult: такой
+// результат нельзя передать дальше в JSON.
+func Resolve(a, b float64, operator string) (float64, error) {
+	result, err := resolve(a, b, operator)
+	if err != nil {
+		return 0, err
+	}
+	return finite(result)
 }
 
-func Resolve(a, b float64, operator string) (float64, error) {
+func resolve(a, b float64, operator string) (float64, error) {
 	switch operator {
 	case "+":
 		return a + b, nil
@@ -72,103 +65,68 @@ func Resolve(a, b float64, operator string) (float64, error) {
 			return 0, errors.ErrDivisionByZero
 		}
 		return a / b, nil
+	case "//":
+		if b == 0 {
+			return 0, errors.ErrDivisionByZero
+		}
+		return math.Floor(a / b), nil
+	case "%":
+		// Остаток согласован с // (деление с округлением вниз): a == (a // b) * b + a % b,
+		// поэтому знак остатка совпадает со знаком делителя.
+		if b == 0 {
+			return 0, errors.ErrDivisionByZero
+		}
+		return a - b*math.Floor(a/b), nil
+	case "^":
+		return math.Pow(a, b), nil
 	default:
 		return 0, errors.ErrOperatorNotSupported
 	}
 }
 
-// https://www.youtube.com/watch?v=Vk-tGND2bfc
-func Evaluate(tokens []string) (float64, error) {
-	var numbers []float64
-	var operators []string
-
-	for _, token := range tokens {
-		if num, err := strconv.ParseFloat(token, 64); err == nil {
-			numbers = append(numbers, num)
-		} else if IsOperator(rune(token[0])) {
-			for len(operators) > 0 && Priority(token) <= Priority(operators[len(operators)-1]) {
-				if len(numbers) < 2 {
-					return 0, errors.ErrExtraOperator
-				}
-
-				num2 := numbers[len(numbers)-1]
-				numbers = numbers[:len(numbers)-1]
-
-				num1 := numbers[len(numbers)-1]
-				numbers = numbers[:len(numbers)-1]
-
-				operator := operators[len(operators)-1]
-				operators = operators[:len(operators)-1]
-
-				res, err := Resolve(num1, num2, operator)
-				if err != nil {
-					return 0, err
-				}
-
-				numbers = append(numbers, res)
-			}
-			operators = append(operators, token)
-		} else if token == "(" {
-			operators = append(operators, token)
-		} else if token == ")" {
-			for len(operators) > 0 && operators[len(operators)-1] != "(" {
-				num2 := numbers[len(numbers)-1]
-				numbers = numbers[:len(numbers)-1]
-
-				num1 := numbers[len(numbers)-1]
-				numbers = numbers[:len(numbers)-1]
-
-				operator := operators[len(operators)-1]
-				operators = operators[:len(operators)-1]
-
-				res, err := Resolve(num1, num2, operator)
-				if err != nil {
-					return 0, err
-				}
-
-				numbers = append(numbers, res)
-			}
-			if len(operators) > 0 {
-				operators = operators[:len(operators)-1]
-			}
-		}
+// finite возвращает value или ErrNonFiniteResult, если это бесконечность или NaN.
+func finite(value float64) (float64, error) {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, errors.ErrNonFiniteResult
 	}
+	return value, nil
+}
 
-	for len(operators) > 0 {
-		if len(numbers) < 2 {
-			return 0, errors.ErrExtraOperator
+// Apply применяет операцию к аргументам: унарный минус, бинарный оператор
+// или функцию из реестра.
+func Apply(operation string, args []float64) (float64, error) {
+	switch {
+	case IsFunction(operation):
+		return CallFunction(operation, args)
+	case IsUnary(operation):
+		if len(args) != 1 {
+			return 0, errors.ErrInvalidExpression
 		}
-
-		num2 := numbers[len(numbers)-1]
-		numbers = numbers[:len(numbers)-1]
-
-		num1 := numbers[len(numbers)-1]
-		numbers = numbers[:len(numbers)-1]
-
-		operator := operators[len(operators)-1]
-		operators = operators[:len(operators)-1]
-
-		res, err := Resolve(num1, num2, operator)
-		if err != nil {
-			return 0, err
+		return ResolveUnary(args[0], operation)
+	default:
+		if len(args) != 2 {
+			return 0, errors.ErrInvalidExpression
 		}
-
-		numbers = append(numbers, res)
-	}
-
-	if len(numbers) != 1 {
-		return 0, errors.ErrInvalidExpression
+		return Resolve(args[0], args[1], operation)
 	}
+}
 
-	return numbers[0], nil
+// Operations возвращает все операции, которые выполняет Apply: бинарные
+// операторы, унарный минус и функции из реестра.
+func Operations() []string {
+	return append([]string{"+", "-", "*", "/", "//", "%", "^", Negation}, FunctionNames()...)
 }
 
 func Priority(operator string) int {
 	switch operator {
 	case "+", "-":
 		return 1
-	case "*", "/":
+	case "*", "/", "//", "%":
 		return 2
+	case Negation:
+		return 3
+	case "^":
+		return 4
 	default:
 		return 0
 	}
@@ -1,6 +1,10 @@
 package calculator
 
-import "testing"
+import (
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"strings"
+	"testing"
+)
 
 func TestCalc(t *testing.T) {
 	tests := []struct {
@@ -39,6 +43,174 @@ func TestCalc(t *testing.T) {
 			want:       0,
 			wantErr:    false,
 		},
+		{
+			name:       "Unary minus at start",
+			expression: "-3 + 2",
+			want:       -1,
+			wantErr:    false,
+		},
+		{
+			name:       "Unary minus in brackets",
+			expression: "2 * (-1)",
+			want:       -2,
+			wantErr:    false,
+		},
+		{
+			name:       "Unary minus before bracket",
+			expression: "(-(4))",
+			want:       -4,
+			wantErr:    false,
+		},
+		{
+			name:       "Unary minus after operator",
+			expression: "2 - -3 * 2",
+			want:       8,
+			wantErr:    false,
+		},
+		{
+			name:       "Unary plus",
+			expression: "+2 * +3",
+			want:       6,
+			wantErr:    false,
+		},
+		{
+			name:       "Double negation",
+			expression: "--2",
+			want:       2,
+			wantErr:    false,
+		},
+		{
+			name:       "Lone minus",
+			expression: "-",
+			want:       0,
+			wantErr:    true,
+		},
+		{
+			name:       "Exponentiation",
+			expression: "2 ^ 3 * 2",
+			want:       16,
+			wantErr:    false,
+		},
+		{
+			name:       "Exponentiation is right-associative",
+			expression: "2 ^ 3 ^ 2",
+			want:       512,
+			wantErr:    false,
+		},
+		{
+			name:       "Exponentiation binds tighter than unary minus",
+			expression: "-2 ^ 2",
+			want:       -4,
+			wantErr:    false,
+		},
+		{
+			name:       "Negative exponent",
+			expression: "2 ^ -1",
+			want:       0.5,
+			wantErr:    false,
+		},
+		{
+			name:       "Modulo",
+			expression: "7 % 4 + 1",
+			want:       4,
+			wantErr:    false,
+		},
+		{
+			name:       "Integer division",
+			expression: "7 // 2 * 2",
+			want:       6,
+			wantErr:    false,
+		},
+		{
+			name:       "Modulo of negative number",
+			expression: "-7 % 2",
+			want:       1,
+			wantErr:    false,
+		},
+		{
+			name:       "Modulo by negative number",
+			expression: "7 % -2",
+			want:       -1,
+			wantErr:    false,
+		},
+		{
+			name:       "Integer division and modulo agree",
+			expression: "(-7 // 2) * 2 + -7 % 2",
+			want:       -7,
+			wantErr:    false,
+		},
+		{
+			name:       "Modulo by zero",
+			expression: "1 % 0",
+			want:       0,
+			wantErr:    true,
+		},
+		{
+			name:       "Integer division by zero",
+			expression: "1 // 0",
+			want:       0,
+			wantErr:    true,
+		},
+		{
+			name:       "Function",
+			expression: "sqrt(16) + abs(-2)",
+			want:       6,
+			wantErr:    false,
+		},
+		{
+			name:       "Variadic function",
+			expression: "max(1, 2 * 3, -4) - min(5)",
+			want:       1,
+			wantErr:    false,
+		},
+		{
+			name:       "Nested functions",
+			expression: "round(log(max(8, 2), 2) * 1.4)",
+			want:       4,
+			wantErr:    false,
+		},
+		{
+			name:       "Trigonometry",
+			expression: "sin(0) + cos(0)",
+			want:       1,
+			wantErr:    false,
+		},
+		{
+			name:       "Unknown function",
+			expression: "foo(1)",
+			want:       0,
+			wantErr:    true,
+		},
+		{
+			name:       "Wrong arguments count",
+			expression: "sqrt(1, 2)",
+			want:       0,
+			wantErr:    true,
+		},
+		{
+			name:       "Function without arguments list",
+			expression: "sqrt 4",
+			want:       0,
+			wantErr:    true,
+		},
+		{
+			name:       "Square root of negative",
+			expression: "sqrt(-1)",
+			want:       0,
+			wantErr:    true,
+		},
+		{
+			name:       "Constants",
+			expression: "round(pi * 100) + e - e",
+			want:       314,
+			wantErr:    false,
+		},
+		{
+			name:       "Undefined variable",
+			expression: "rate * 2",
+			want:       0,
+			wantErr:    true,
+		},
 		{
 			name:       "Full empty input",
 			expression: "",
@@ -116,6 +288,11 @@ func TestTokenize(t *testing.T) {
 		{"1 + 2", []string{"1", "+", "2"}},
 		{"(1 + 2) * 3", []string{"(", "1", "+", "2", ")", "*", "3"}},
 		{"1.5 * (2 - 3)", []string{"1.5", "*", "(", "2", "-", "3", ")"}},
+		{"-3 + 2", []string{Negation, "3", "+", "2"}},
+		{"2 * (-1)", []string{"2", "*", "(", Negation, "1", ")"}},
+		{"1 - +2", []string{"1", "-", "2"}},
+		{"7 // 2 % 3 ^ 2", []string{"7", "//", "2", "%", "3", "^", "2"}},
+		{"max(1, -x2)", []string{"max", "(", "1", ",", Negation, "x2", ")"}},
 	}
 
 	for _, test := range tests {
@@ -149,6 +326,16 @@ func TestToRPN(t *testing.T) {
 		{[]string{"1", "+", "2"}, []string{"1", "2", "+"}},
 		{[]string{"(", "1", "+", "2", ")", "*", "3"}, []string{"1", "2", "+", "3", "*"}},
 		{[]string{"1.5", "*", "(", "2", "-", "3", ")"}, []string{"1.5", "2", "3", "-", "*"}},
+		{[]string{Negation, "3", "+", "2"}, []string{"3", Negation, "2", "+"}},
+		{[]string{"-", "3"}, []string{"3", Negation}},
+		{[]string{"+", "3", "-", "2"}, []string{"3", "2", "-"}},
+		{[]string{"2", "*", "(", "-", "1", ")"}, []string{"2", "1", Negation, "*"}},
+		{[]string{"1", "-", "-", "2"}, []string{"1", "2", Negation, "-"}},
+		{[]string{"2", "^", "3", "^", "2"}, []string{"2", "3", "2", "^", "^"}},
+		{[]string{"7", "//", "2", "%", "3"}, []string{"7", "2", "//", "3", "%"}},
+		{[]string{"max", "(", "1", ",", "2", "+", "3", ")", "*", "2"}, []string{"1", "2", "3", "+", "max:2", "2", "*"}},
+		{[]string{"(", "1", "-", "2", "+", "3", ")"}, []string{"1", "2", "-", "3", "+"}},
+		{[]string{"(", "8", "/", "2", "*", "2", ")"}, []string{"8", "2", "/", "2", "*"}},
 	}
 
 	for _, test := range tests {
@@ -163,6 +350,33 @@ func TestToRPN(t *testing.T) {
 }
 
 func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		input    []string
+		expected float64
+	}{
+		{[]string{"1", "+", "2"}, 3},
+		{[]string{"3", "-", "2"}, 1},
+		{[]string{"2", "*", "3"}, 6},
+		{[]string{"6", "/", "2"}, 3},
+		{[]string{"(", "1", "+", "2", ")", "*", "3"}, 9},
+		{[]string{"-", "3", "+", "2"}, -1},
+		{[]string{"+", "3", "-", "2"}, 1},
+		{[]string{"2", "*", "(", "-", "1", ")"}, -2},
+		{[]string{"(", "+", "4", ")", "-", "-", "1"}, 5},
+	}
+
+	for _, test := range tests {
+		result, err := Evaluate(test.input)
+		if err != nil {
+			t.Errorf("Evaluate(%v) returned error: %v", test.input, err)
+		}
+		if result != test.expected {
+			t.Errorf("Evaluate(%v) = %v, expected %v", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestEvaluateRPN(t *testing.T) {
 	tests := []struct {
 		input    []string
 		expected float64
@@ -174,12 +388,268 @@ func TestEvaluate(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result, err := Evaluate(test.input)
+		result, err := EvaluateRPN(test.input)
 		if err != nil {
-			t.Errorf("Evaluate(%v) returned error: %v", test.input, err)
+			t.Errorf("EvaluateRPN(%v) returned error: %v", test.input, err)
 		}
 		if result != test.expected {
-			t.Errorf("Evaluate(%v) = %v, expected %v", test.input, result, test.expected)
+			t.Errorf("EvaluateRPN(%v) = %v, expected %v", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestEvaluateRPNError(t *testing.T) {
+	tests := []struct {
+		input []string
+		err   error
+	}{
+		{[]string{"1", "max:-1"}, errors.ErrInvalidExpression},
+		{[]string{"1", "max:x"}, errors.ErrInvalidExpression},
+		{[]string{"1", "max:2"}, errors.ErrInvalidExpression},
+		{[]string{"1", "+"}, errors.ErrExtraOperator},
+		{[]string{"1", "2"}, errors.ErrInvalidExpression},
+	}
+
+	for _, test := range tests {
+		if _, err := EvaluateRPN(test.input); !errors.Is(err, test.err) {
+			t.Errorf("EvaluateRPN(%v) error = %v, expected %v", test.input, err, test.err)
+		}
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	RegisterFunction("double", Function{MinArgs: 1, MaxArgs: 1, Call: func(args []float64) (float64, error) {
+		return args[0] * 2, nil
+	}})
+
+	got, err := Calc("double(2) + 1")
+	if err != nil {
+		t.Fatalf("Calc() returned error: %v", err)
+	}
+	if got != 5 {
+		t.Errorf("Calc() = %v, want 5", got)
+	}
+}
+
+func TestNonFiniteResult(t *testing.T) {
+	RegisterFunction("twice", Function{MinArgs: 1, MaxArgs: 1, Call: func(args []float64) (float64, error) {
+		return args[0] * 2, nil
+	}})
+
+	variables := map[string]float64{"big": 1e308}
+	for _, expression := range []string{"2 ^ 2000", "big * 10", "-big - big", "(-8) ^ 0.5", "twice(big)"} {
+		if got, err := CalcWithVariables(expression, variables); !errors.Is(err, errors.ErrNonFiniteResult) {
+			t.Errorf("Calc(%s) = %v, %v, expected %v", expression, got, err, errors.ErrNonFiniteResult)
+		}
+	}
+
+	if _, err := Apply("^", []float64{-8, 0.5}); !errors.Is(err, errors.ErrNonFiniteResult) {
+		t.Errorf("Apply(^, -8, 0.5) returned error %v, expected %v", err, errors.ErrNonFiniteResult)
+	}
+}
+
+func TestCalcWithVariables(t *testing.T) {
+	variables := map[string]float64{"rate": 0.12, "principal": 1000, "e": -1}
+
+	got, err := CalcWithVariables("rate * principal / 12 + e", variables)
+	if err != nil {
+		t.Fatalf("CalcWithVariables() returned error: %v", err)
+	}
+	if got != 9 {
+		t.Errorf("CalcWithVariables() = %v, want 9", got)
+	}
+
+	_, err = CalcWithVariables("rate * months", variables)
+	if !errors.Is(err, errors.ErrUndefinedVariable) {
+		t.Errorf("CalcWithVariables() error = %v, want %v", err, errors.ErrUndefinedVariable)
+	}
+}
+
+func TestParsePositions(t *testing.T) {
+	node, err := Parse("1 + max(2, -x) * 3")
+	if err != nil {
+		t.Fatalf("Parse() returned error: %v", err)
+	}
+
+	sum, ok := node.(*BinaryNode)
+	if !ok || sum.Op != "+" || sum.Pos() != 2 {
+		t.Fatalf("Parse() root = %#v, expected + at 2", node)
+	}
+	product, ok := sum.Right.(*BinaryNode)
+	if !ok || product.Op != "*" || product.Pos() != 15 {
+		t.Fatalf("Parse() right = %#v, expected * at 15", sum.Right)
+	}
+	call, ok := product.Left.(*CallNode)
+	if !ok || call.Name != "max" || call.Pos() != 4 || len(call.Arguments) != 2 {
+		t.Fatalf("Parse() call = %#v, expected max at 4 with two arguments", product.Left)
+	}
+	neg, ok := call.Arguments[1].(*UnaryNode)
+	if !ok || neg.Pos() != 11 || neg.Operand.Pos() != 12 {
+		t.Fatalf("Parse() negation = %#v, expected - at 11", call.Arguments[1])
+	}
+}
+
+func TestCalcAgreesWithRPN(t *testing.T) {
+	expressions := []string{
+		"(1 - 2 + 3)",
+		"(8 / 2 * 2)",
+		"2 * (3 - 4 / (1 + 1)) ^ 2",
+		"-2 ^ 2 + 2 ^ -1",
+		"max(1, 7 // 2, 5 % 3) - sqrt(16)",
+		"2 ^ 3 ^ 2 - pi",
+	}
+
+	for _, expression := range expressions {
+		want, err := Calc(expression)
+		if err != nil {
+			t.Errorf("Calc(%s) returned error: %v", expression, err)
+			continue
+		}
+
+		tokens, err := Tokenize(expression)
+		if err != nil {
+			t.Errorf("Tokenize(%s) returned error: %v", expression, err)
+			continue
+		}
+		if got, err := Evaluate(tokens); got != want || err != nil {
+			t.Errorf("Evaluate(Tokenize(%s)) = %v, %v, Calc() = %v", expression, got, err, want)
+		}
+
+		rpn, err := ToRPN(tokens)
+		if err != nil {
+			t.Errorf("ToRPN(%v) returned error: %v", tokens, err)
+			continue
+		}
+		got, err := EvaluateRPN(rpn)
+		if err != nil {
+			t.Errorf("EvaluateRPN(%v) returned error: %v", rpn, err)
+			continue
+		}
+
+		if got != want {
+			t.Errorf("EvaluateRPN(ToRPN(%s)) = %v, Calc() = %v", expression, got, want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        error
+		offset     int
+		token      string
+		expected   string
+	}{
+		{"1 + 2 & 3", errors.ErrUnacceptableSymbol, 6, "&", ""},
+		{"٣+1", errors.ErrUnacceptableSymbol, 0, "٣", ""},
+		{"1 + * 2", errors.ErrExtraOperator, 4, "*", `number, name or "("`},
+		{"(1 + 2", errors.ErrExtraOpenBracket, 6, "", `")"`},
+		{"1 + 2)", errors.ErrExtraCloseBracket, 5, ")", "operator or end of expression"},
+		{"2 (8)", errors.ErrInvalidExpression, 2, "(", "operator or end of expression"},
+		{"1 -", errors.ErrExtraOperator, 2, "-", `number, name or "("`},
+		{"foo(1)", errors.ErrUnknownFunction, 0, "foo", ""},
+		{"1 + sqrt(1, 2)", errors.ErrWrongArgumentsCount, 4, "sqrt", "1 argument"},
+		{"max(1 2)", errors.ErrInvalidExpression, 6, "2", `"," or ")"`},
+		{"2 * rate", errors.ErrUndefinedVariable, 4, "rate", ""},
+		{"1.2.3", errors.ErrInvalidExpression, 0, "1.2.3", "number"},
+	}
+
+	for _, test := range tests {
+		_, err := Calc(test.expression)
+
+		var parseErr *errors.ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("Calc(%s) error = %v, expected *ParseError", test.expression, err)
+			continue
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("Calc(%s) error = %v, expected %v", test.expression, err, test.err)
+		}
+		if parseErr.Offset != test.offset || parseErr.Token != test.token || parseErr.Expected != test.expected {
+			t.Errorf("Calc(%s) error = %+v, expected offset %d, token %q, expected %q",
+				test.expression, *parseErr, test.offset, test.token, test.expected)
+		}
+	}
+}
+
+func TestOperations(t *testing.T) {
+	for _, operation := range Operations() {
+		args := []float64{4, 2}
+		if IsUnary(operation) {
+			args = args[:1]
+		} else if fn, ok := LookupFunction(operation); ok {
+			args = args[:fn.MinArgs]
+		}
+
+		if _, err := Apply(operation, args); err != nil {
+			t.Errorf("Apply(%q, %v) returned error: %v", operation, args, err)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	variables := map[string]float64{"a": 2, "b": 3}
+	all := func(string) bool { return true }
+	onlyAddition := func(operation string) bool { return operation == "+" }
+
+	tests := []struct {
+		expression string
+		fold       func(string) bool
+		want       string
+		rules      []string
+	}{
+		{"(a + b) * 1", nil, "2 + 3", []string{RuleIdentity}},
+		{"0 + (a + b) ^ 1 - 0", nil, "2 + 3", []string{RuleIdentity, RuleIdentity, RuleIdentity}},
+		{"1 * (a * b) / 1", nil, "2 * 3", []string{RuleIdentity, RuleIdentity}},
+		{"--(a + b)", nil, "2 + 3", []string{RuleIdentity}},
+		{"a ^ 0", nil, "1", []string{RuleIdentity}},
+		{"(a + b) ^ 0", nil, "(2 + 3) ^ 0", nil},
+		{"(1 / 0) ^ 0", all, "(1 / 0) ^ 0", nil},
+		{"sqrt(-1) ^ 0", all, "sqrt(-1) ^ 0", nil},
+		{"(a + b) * 0", nil, "(2 + 3) * 0", nil},
+		{"-3 + a", nil, "(-3) + 2", nil},
+		{"b * (1 + a)", onlyAddition, "3 * 3", []string{RuleConstant}},
+		{"sqrt(4) * (a + 1) * 1", all, "6", []string{RuleConstant, RuleConstant, RuleConstant, RuleIdentity}},
+		{"1 / 0 + a", all, "(1 / 0) + 2", nil},
+	}
+
+	for _, test := range tests {
+		node, err := Parse(test.expression)
+		if err != nil {
+			t.Fatalf("Parse(%s) returned error: %v", test.expression, err)
+		}
+		optimized, rewrites, err := Optimize(node, variables, test.fold)
+		if err != nil {
+			t.Fatalf("Optimize(%s) returned error: %v", test.expression, err)
+		}
+		if got := Format(optimized); got != test.want {
+			t.Errorf("Optimize(%s) = %s, expected %s", test.expression, got, test.want)
+		}
+		var rules []string
+		for _, rewrite := range rewrites {
+			rules = append(rules, rewrite.Rule)
+		}
+		if strings.Join(rules, ",") != strings.Join(test.rules, ",") {
+			t.Errorf("Optimize(%s) applied %v, expected %v", test.expression, rules, test.rules)
 		}
+
+		// Упрощённое выражение вычисляется так же, как исходное, и его запись
+		// разбирается обратно.
+		want, wantErr := Eval(node, variables)
+		got, gotErr := Eval(optimized, nil)
+		if got != want || (gotErr == nil) != (wantErr == nil) {
+			t.Errorf("Optimize(%s) evaluates to %v, %v, expected %v, %v", test.expression, got, gotErr, want, wantErr)
+		}
+		reparsed, err := Parse(test.want)
+		if err != nil {
+			t.Errorf("Parse(%s) returned error: %v", test.want, err)
+		} else if value, err := Eval(reparsed, nil); value != got || (err == nil) != (gotErr == nil) {
+			t.Errorf("Format(%s) evaluates to %v, %v, expected %v, %v", test.expression, value, err, got, gotErr)
+		}
+	}
+
+	node, _ := Parse("a * x")
+	if _, _, err := Optimize(node, variables, nil); !errors.Is(err, errors.ErrUndefinedVariable) {
+		t.Errorf("Optimize(a * x) returned error %v, expected %v", err, errors.ErrUndefinedVariable)
 	}
 }
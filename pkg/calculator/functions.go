@@ -0,0 +1,154 @@
+package calculator
+
+import (
+	"fmt"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Variadic — значение MaxArgs для функций с неограниченным числом аргументов.
+const Variadic = -1
+
+// Function описывает встроенную функцию выражений. Новые функции подключаются
+// через RegisterFunction без изменений в разборе выражений.
+type Function struct {
+	MinArgs int
+	MaxArgs int
+	Call    func(args []float64) (float64, error)
+}
+
+var (
+	functions      = make(map[string]Function)
+	functionsMutex sync.RWMutex
+)
+
+func init() {
+	RegisterFunction("sqrt", Function{MinArgs: 1, MaxArgs: 1, Call: func(args []float64) (float64, error) {
+		if args[0] < 0 {
+			return 0, errors.ErrInvalidArgument
+		}
+		return math.Sqrt(args[0]), nil
+	}})
+	RegisterFunction("abs", Function{MinArgs: 1, MaxArgs: 1, Call: unary(math.Abs)})
+	RegisterFunction("sin", Function{MinArgs: 1, MaxArgs: 1, Call: unary(math.Sin)})
+	RegisterFunction("cos", Function{MinArgs: 1, MaxArgs: 1, Call: unary(math.Cos)})
+	RegisterFunction("round", Function{MinArgs: 1, MaxArgs: 1, Call: unary(math.Round)})
+	RegisterFunction("log", Function{MinArgs: 1, MaxArgs: 2, Call: func(args []float64) (float64, error) {
+		// log(x) — натуральный логарифм, log(x, b) — логарифм по основанию b.
+		for _, arg := range args {
+			if arg <= 0 {
+				return 0, errors.ErrInvalidArgument
+			}
+		}
+		if len(args) == 1 {
+			return math.Log(args[0]), nil
+		}
+		if args[1] == 1 {
+			return 0, errors.ErrInvalidArgument
+		}
+		return math.Log(args[0]) / math.Log(args[1]), nil
+	}})
+	RegisterFunction("min", Function{MinArgs: 1, MaxArgs: Variadic, Call: func(args []float64) (float64, error) {
+		res := args[0]
+		for _, arg := range args[1:] {
+			res = math.Min(res, arg)
+		}
+		return res, nil
+	}})
+	RegisterFunction("max", Function{MinArgs: 1, MaxArgs: Variadic, Call: func(args []float64) (float64, error) {
+		res := args[0]
+		for _, arg := range args[1:] {
+			res = math.Max(res, arg)
+		}
+		return res, nil
+	}})
+}
+
+func unary(fn func(float64) float64) func(args []float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		return fn(args[0]), nil
+	}
+}
+
+// RegisterFunction добавляет функцию в реестр или заменяет уже существующую.
+func RegisterFunction(name string, fn Function) {
+	functionsMutex.Lock()
+	defer functionsMutex.Unlock()
+
+	functions[name] = fn
+}
+
+func LookupFunction(name string) (Function, bool) {
+	functionsMutex.RLock()
+	defer functionsMutex.RUnlock()
+
+	fn, exists := functions[name]
+	return fn, exists
+}
+
+// FunctionNames возвращает имена зарегистрированных функций по алфавиту.
+func FunctionNames() []string {
+	functionsMutex.RLock()
+	defer functionsMutex.RUnlock()
+
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func IsFunction(token string) bool {
+	_, exists := LookupFunction(token)
+	return exists
+}
+
+// CheckArity проверяет, что функцию можно вызвать с argc аргументами.
+func (f Function) CheckArity(argc int) error {
+	if argc < f.MinArgs || (f.MaxArgs != Variadic && argc > f.MaxArgs) {
+		return errors.ErrWrongArgumentsCount
+	}
+	return nil
+}
+
+// CallFunction вызывает функцию из реестра; как и у операторов, бесконечный
+// результат или NaN — ошибка ErrNonFiniteResult.
+func CallFunction(name string, args []float64) (float64, error) {
+	fn, exists := LookupFunction(name)
+	if !exists {
+		return 0, errors.ErrUnknownFunction
+	}
+	if err := fn.CheckArity(len(args)); err != nil {
+		return 0, err
+	}
+	result, err := fn.Call(args)
+	if err != nil {
+		return 0, err
+	}
+	return finite(result)
+}
+
+// FunctionToken записывает вызов функции в RPN вместе с числом аргументов,
+// например "max:3".
+func FunctionToken(name string, argc int) string {
+	return fmt.Sprintf("%s:%d", name, argc)
+}
+
+// ParseFunctionToken разбирает токен, построенный FunctionToken; токен с
+// отрицательным числом аргументов не принимается.
+func ParseFunctionToken(token string) (string, int, bool) {
+	name, count, found := strings.Cut(token, ":")
+	if !found {
+		return "", 0, false
+	}
+	argc, err := strconv.Atoi(count)
+	if err != nil || argc < 0 {
+		return "", 0, false
+	}
+	return name, argc, true
+}
@@ -0,0 +1,180 @@
+package calculator
+
+import (
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Negation — токен унарного минуса. Во входной строке он записывается как
+// обычный "-", а лексер различает их по контексту.
+const Negation = "~"
+
+type TokenKind int
+
+const (
+	TokenNumber TokenKind = iota
+	TokenIdent
+	TokenOperator
+	TokenNegation
+	TokenLeftParen
+	TokenRightParen
+	TokenComma
+)
+
+// Token — лексема выражения. Pos — смещение в байтах от начала строки.
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int
+}
+
+func Lex(expression string) ([]Token, error) {
+	var tokens []Token
+
+	for i := 0; i < len(expression); {
+		r, size := utf8.DecodeRuneInString(expression[i:])
+		start := i
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case r < utf8.RuneSelf && isDigit(byte(r)) || r == '.':
+			for i < len(expression) && (isDigit(expression[i]) || expression[i] == '.') {
+				i++
+			}
+			if _, err := strconv.ParseFloat(expression[start:i], 64); err != nil {
+				return nil, &errors.ParseError{Err: errors.ErrInvalidExpression, Offset: start, Token: expression[start:i], Expected: "number"}
+			}
+			tokens = append(tokens, Token{Kind: TokenNumber, Text: expression[start:i], Pos: start})
+			continue
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(expression) {
+				r, size := utf8.DecodeRuneInString(expression[i:])
+				if !isIdentRune(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, Token{Kind: TokenIdent, Text: expression[start:i], Pos: start})
+			continue
+		}
+
+		i += size
+		switch {
+		case r == '(':
+			tokens = append(tokens, Token{Kind: TokenLeftParen, Text: "(", Pos: start})
+		case r == ')':
+			tokens = append(tokens, Token{Kind: TokenRightParen, Text: ")", Pos: start})
+		case r == ',':
+			tokens = append(tokens, Token{Kind: TokenComma, Text: ",", Pos: start})
+		case r == '/' && i < len(expression) && expression[i] == '/':
+			i++
+			tokens = append(tokens, Token{Kind: TokenOperator, Text: "//", Pos: start})
+		case (r == '-' || r == '+') && isUnaryPosition(tokens):
+			// Унарный плюс ничего не меняет, поэтому в токены не попадает.
+			if r == '-' {
+				tokens = append(tokens, Token{Kind: TokenNegation, Text: Negation, Pos: start})
+			}
+		case IsOperator(r):
+			tokens = append(tokens, Token{Kind: TokenOperator, Text: string(r), Pos: start})
+		default:
+			return nil, &errors.ParseError{Err: errors.ErrUnacceptableSymbol, Offset: start, Token: string(r)}
+		}
+	}
+
+	return tokens, nil
+}
+
+// Tokenize разбивает выражение на текстовые лексемы.
+func Tokenize(expression string) ([]string, error) {
+	tokens, err := Lex(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	texts := make([]string, len(tokens))
+	for i, token := range tokens {
+		texts[i] = token.Text
+	}
+	return texts, nil
+}
+
+// classify восстанавливает лексемы по результату Tokenize. Позиции считаются
+// так, будто лексемы записаны подряд без пробелов. Знаки "-" и "+" там, где
+// не может быть бинарного оператора, разбираются так же, как в Lex.
+func classify(texts []string) ([]Token, error) {
+	tokens := make([]Token, 0, len(texts))
+	pos := 0
+
+	for _, text := range texts {
+		token := Token{Text: text, Pos: pos}
+		pos += len(text)
+		switch {
+		case text == "":
+			return nil, &errors.ParseError{Err: errors.ErrUnacceptableSymbol, Offset: token.Pos}
+		case text == "(":
+			token.Kind = TokenLeftParen
+		case text == ")":
+			token.Kind = TokenRightParen
+		case text == ",":
+			token.Kind = TokenComma
+		case IsUnary(text):
+			token.Kind = TokenNegation
+		case (text == "-" || text == "+") && isUnaryPosition(tokens):
+			if text == "+" {
+				continue
+			}
+			token.Kind = TokenNegation
+			token.Text = Negation
+		case IsIdentifier(text):
+			token.Kind = TokenIdent
+		default:
+			if _, err := strconv.ParseFloat(text, 64); err == nil {
+				token.Kind = TokenNumber
+			} else if text == "//" || (len(text) == 1 && IsOperator(rune(text[0]))) {
+				token.Kind = TokenOperator
+			} else {
+				return nil, &errors.ParseError{Err: errors.ErrUnacceptableSymbol, Offset: token.Pos, Token: text}
+			}
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// isIdentRune сообщает, может ли символ входить в имя. Цифры допустимы
+// везде, кроме первой позиции.
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// IsIdentifier сообщает, является ли токен именем, а не числом или знаком.
+func IsIdentifier(token string) bool {
+	if token == "" {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(token)
+	return unicode.IsLetter(r) || r == '_'
+}
+
+// isUnaryPosition сообщает, стоит ли очередной знак там, где не может быть
+// бинарного оператора: в начале выражения, после "(", "," или другого оператора.
+func isUnaryPosition(tokens []Token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	switch tokens[len(tokens)-1].Kind {
+	case TokenLeftParen, TokenComma, TokenOperator, TokenNegation:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,205 @@
+package calculator
+
+import (
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// Правила, по которым Optimize упрощает операции.
+const (
+	// RuleConstant — операция над числами вычислена сразу.
+	RuleConstant = "constant"
+	// RuleIdentity — операция не меняет аргумент (x*1, x+0, x^1, --x) или
+	// её результат не зависит от него (x^0).
+	RuleIdentity = "identity"
+)
+
+// Rewrite — одно упрощение, сделанное Optimize: операция в позиции Position
+// заменена выражением Result.
+type Rewrite struct {
+	Position  int    `json:"position"`
+	Operation string `json:"operation"`
+	Rule      string `json:"rule"`
+	Result    string `json:"result"`
+}
+
+// Optimize подставляет значения переменных и упрощает дерево выражения:
+// вычисляет операции над числами, для которых fold возвращает true, и
+// убирает тождественные операции. Операция, вычисление которой завершилось
+// ошибкой (например, деление на ноль), остаётся в дереве. Исходное дерево
+// не меняется; упрощения возвращаются в порядке применения.
+func Optimize(node Node, variables map[string]float64, fold func(operation string) bool) (Node, []Rewrite, error) {
+	o := &optimizer{variables: variables, fold: fold}
+	node, err := o.optimize(node)
+	if err != nil {
+		return nil, nil, err
+	}
+	return node, o.rewrites, nil
+}
+
+type optimizer struct {
+	variables map[string]float64
+	fold      func(operation string) bool
+	rewrites  []Rewrite
+}
+
+func (o *optimizer) optimize(node Node) (Node, error) {
+	switch n := node.(type) {
+	case *NumberNode:
+		return n, nil
+	case *IdentNode:
+		value, err := n.Resolve(o.variables)
+		if err != nil {
+			return nil, err
+		}
+		return number(value, n.Position), nil
+	case *UnaryNode:
+		operand, err := o.optimize(n.Operand)
+		if err != nil {
+			return nil, err
+		}
+		// Знак перед числом — просто отрицательное число, это не упрощение.
+		if num, ok := operand.(*NumberNode); ok {
+			if value, err := ResolveUnary(num.Value, n.Op); err == nil {
+				return number(value, n.Position), nil
+			}
+		}
+		if inner, ok := operand.(*UnaryNode); ok && inner.Op == n.Op && IsUnary(n.Op) {
+			return o.rewrite(n, RuleIdentity, inner.Operand), nil
+		}
+		return &UnaryNode{Op: n.Op, Operand: operand, Position: n.Position}, nil
+	case *BinaryNode:
+		left, err := o.optimize(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := o.optimize(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		if simplified := o.identity(n, left, right); simplified != nil {
+			return simplified, nil
+		}
+		optimized := &BinaryNode{Op: n.Op, Left: left, Right: right, Position: n.Position}
+		return o.constant(optimized), nil
+	case *CallNode:
+		args := make([]Node, len(n.Arguments))
+		for i, arg := range n.Arguments {
+			optimized, err := o.optimize(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = optimized
+		}
+		return o.constant(&CallNode{Name: n.Name, Arguments: args, Position: n.Position}), nil
+	default:
+		return nil, errors.ErrInvalidExpression
+	}
+}
+
+// identity упрощает бинарную операцию с нейтральным аргументом или
+// возвращает nil. Правила не меняют результат ни при каких значениях
+// другого аргумента, поэтому x*0 и 0/x не упрощаются. x^0 заменяется на 1,
+// только если x — число: вычисление любого другого x может завершиться
+// ошибкой, которую замена бы скрыла.
+func (o *optimizer) identity(n *BinaryNode, left, right Node) Node {
+	is := func(node Node, value float64) bool {
+		num, ok := node.(*NumberNode)
+		return ok && num.Value == value
+	}
+	isNumber := func(node Node) bool {
+		_, ok := node.(*NumberNode)
+		return ok
+	}
+
+	switch {
+	case n.Op == "+" && is(left, 0):
+		return o.rewrite(n, RuleIdentity, right)
+	case (n.Op == "+" || n.Op == "-") && is(right, 0),
+		(n.Op == "*" || n.Op == "/" || n.Op == "^") && is(right, 1):
+		return o.rewrite(n, RuleIdentity, left)
+	case n.Op == "*" && is(left, 1):
+		return o.rewrite(n, RuleIdentity, right)
+	case n.Op == "^" && is(right, 0) && isNumber(left):
+		return o.rewrite(n, RuleIdentity, number(1, n.Position))
+	}
+	return nil
+}
+
+// constant вычисляет операцию, если все её аргументы — числа и fold её
+// разрешает; иначе возвращает операцию без изменений.
+func (o *optimizer) constant(n OperationNode) Node {
+	if o.fold == nil || !o.fold(n.Operation()) {
+		return n
+	}
+	args := n.Args()
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		num, ok := arg.(*NumberNode)
+		if !ok {
+			return n
+		}
+		values[i] = num.Value
+	}
+	value, err := Apply(n.Operation(), values)
+	if err != nil {
+		return n
+	}
+	return o.rewrite(n, RuleConstant, number(value, n.Pos()))
+}
+
+func (o *optimizer) rewrite(n OperationNode, rule string, result Node) Node {
+	o.rewrites = append(o.rewrites, Rewrite{
+		Position:  n.Pos(),
+		Operation: n.Operation(),
+		Rule:      rule,
+		Result:    Format(result),
+	})
+	return result
+}
+
+func number(value float64, position int) *NumberNode {
+	return &NumberNode{Value: value, Text: strconv.FormatFloat(value, 'g', -1, 64), Position: position}
+}
+
+// Format записывает дерево выражения текстом, который снова разбирается
+// Parse в то же дерево. Аргументы операторов, кроме неотрицательных чисел,
+// имён и вызовов, берутся в скобки.
+func Format(node Node) string {
+	switch n := node.(type) {
+	case *NumberNode:
+		if n.Text == "" {
+			return strconv.FormatFloat(n.Value, 'g', -1, 64)
+		}
+		return n.Text
+	case *IdentNode:
+		return n.Name
+	case *UnaryNode:
+		return "-" + formatOperand(n.Operand)
+	case *BinaryNode:
+		return formatOperand(n.Left) + " " + n.Op + " " + formatOperand(n.Right)
+	case *CallNode:
+		args := make([]string, len(n.Arguments))
+		for i, arg := range n.Arguments {
+			args[i] = Format(arg)
+		}
+		return n.Name + "(" + strings.Join(args, ", ") + ")"
+	default:
+		return ""
+	}
+}
+
+func formatOperand(node Node) string {
+	switch n := node.(type) {
+	case *UnaryNode, *BinaryNode:
+		return "(" + Format(node) + ")"
+	case *NumberNode:
+		if text := Format(n); strings.HasPrefix(text, "-") {
+			return "(" + text + ")"
+		}
+		return Format(n)
+	default:
+		return Format(node)
+	}
+}
@@ -0,0 +1,295 @@
+package calculator
+
+import (
+	"fmt"
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"strconv"
+)
+
+// Грамматика выражений, от низшего приоритета к высшему:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "//" | "%") unary }
+//	unary   = "-" unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | ident | ident "(" [ expr { "," expr } ] ")" | "(" expr ")"
+//
+// Возведение в степень правоассоциативно и связывает сильнее унарного минуса:
+// -2^2 = -(2^2), 2^-1 = 2^(-1).
+
+// operandHint — подсказка для мест, где ожидается операнд.
+const operandHint = "number, name or \"(\""
+
+// Parse строит синтаксическое дерево выражения. Ошибки разбора возвращаются
+// как *errors.ParseError с позицией в исходной строке.
+func Parse(expression string) (Node, error) {
+	tokens, err := Lex(expression)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokens(tokens, len(expression))
+}
+
+func ParseTokens(tokens []Token) (Node, error) {
+	end := 0
+	if len(tokens) > 0 {
+		last := tokens[len(tokens)-1]
+		end = last.Pos + len(last.Text)
+	}
+	return parseTokens(tokens, end)
+}
+
+func parseTokens(tokens []Token, end int) (Node, error) {
+	p := &parser{tokens: tokens, end: end}
+	if len(tokens) == 0 {
+		return nil, p.errorAtCursor(errors.ErrInvalidExpression, operandHint)
+	}
+
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token, ok := p.peek(); ok {
+		if token.Kind == TokenRightParen {
+			return nil, p.errorAtCursor(errors.ErrExtraCloseBracket, "operator or end of expression")
+		}
+		return nil, p.errorAtCursor(errors.ErrInvalidExpression, "operator or end of expression")
+	}
+
+	return node, nil
+}
+
+type parser struct {
+	tokens []Token
+	pos    int
+	depth  int
+	end    int
+}
+
+// errorAt строит ошибку разбора, указывающую на лексему token.
+func errorAt(err error, token Token, expected string) error {
+	text := token.Text
+	if token.Kind == TokenNegation {
+		text = "-"
+	}
+	return &errors.ParseError{Err: err, Offset: token.Pos, Token: text, Expected: expected}
+}
+
+// errorAtCursor строит ошибку разбора для текущей лексемы или конца выражения.
+func (p *parser) errorAtCursor(err error, expected string) error {
+	if token, ok := p.peek(); ok {
+		return errorAt(err, token, expected)
+	}
+	return &errors.ParseError{Err: err, Offset: p.end, Expected: expected}
+}
+
+func (p *parser) peek() (Token, bool) {
+	if p.pos >= len(p.tokens) {
+		return Token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// peekOperator возвращает следующий бинарный оператор, если он входит в ops.
+func (p *parser) peekOperator(ops ...string) (Token, bool) {
+	token, ok := p.peek()
+	if !ok || token.Kind != TokenOperator {
+		return Token{}, false
+	}
+	for _, op := range ops {
+		if token.Text == op {
+			return token, true
+		}
+	}
+	return Token{}, false
+}
+
+func (p *parser) parseExpr() (Node, error) {
+	return p.parseBinary(p.parseTerm, "+", "-")
+}
+
+func (p *parser) parseTerm() (Node, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "//", "%")
+}
+
+// parseBinary разбирает цепочку левоассоциативных операторов одного приоритета.
+func (p *parser) parseBinary(operand func() (Node, error), ops ...string) (Node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token, ok := p.peekOperator(ops...)
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryNode{Op: token.Text, Left: left, Right: right, Position: token.Pos}
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	token, ok := p.peek()
+	if ok && token.Kind == TokenNegation {
+		p.pos++
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryNode{Op: token.Text, Operand: operand, Position: token.Pos}, nil
+	}
+	return p.parsePower()
+}
+
+func (p *parser) parsePower() (Node, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	token, ok := p.peekOperator("^")
+	if !ok {
+		return base, nil
+	}
+	p.pos++
+
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &BinaryNode{Op: token.Text, Left: base, Right: exponent, Position: token.Pos}, nil
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, p.unexpectedEnd()
+	}
+
+	switch token.Kind {
+	case TokenNumber:
+		p.pos++
+		value, err := strconv.ParseFloat(token.Text, 64)
+		if err != nil {
+			return nil, errorAt(errors.ErrInvalidExpression, token, "number")
+		}
+		return &NumberNode{Value: value, Text: token.Text, Position: token.Pos}, nil
+	case TokenIdent:
+		p.pos++
+		if next, ok := p.peek(); ok && next.Kind == TokenLeftParen {
+			return p.parseCall(token)
+		}
+		return &IdentNode{Name: token.Text, Position: token.Pos}, nil
+	case TokenLeftParen:
+		p.pos++
+		p.depth++
+
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectCloseBracket("\")\""); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case TokenOperator:
+		return nil, errorAt(errors.ErrExtraOperator, token, operandHint)
+	case TokenRightParen:
+		if p.depth == 0 {
+			return nil, errorAt(errors.ErrExtraCloseBracket, token, operandHint)
+		}
+		return nil, errorAt(errors.ErrInvalidExpression, token, operandHint)
+	default:
+		return nil, errorAt(errors.ErrInvalidExpression, token, operandHint)
+	}
+}
+
+// parseCall разбирает список аргументов функции; имя уже прочитано, следующая
+// лексема — "(".
+func (p *parser) parseCall(name Token) (Node, error) {
+	fn, exists := LookupFunction(name.Text)
+	if !exists {
+		return nil, errorAt(errors.ErrUnknownFunction, name, "")
+	}
+
+	p.pos++
+	p.depth++
+
+	var args []Node
+	if token, ok := p.peek(); !ok || token.Kind != TokenRightParen {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			token, ok := p.peek()
+			if !ok || token.Kind != TokenComma {
+				break
+			}
+			p.pos++
+		}
+	}
+
+	if err := p.expectCloseBracket("\",\" or \")\""); err != nil {
+		return nil, err
+	}
+	if err := fn.CheckArity(len(args)); err != nil {
+		return nil, errorAt(err, name, arityHint(fn))
+	}
+
+	return &CallNode{Name: name.Text, Arguments: args, Position: name.Pos}, nil
+}
+
+func (p *parser) expectCloseBracket(expected string) error {
+	token, ok := p.peek()
+	if !ok {
+		return p.errorAtCursor(errors.ErrExtraOpenBracket, expected)
+	}
+	if token.Kind != TokenRightParen {
+		return errorAt(errors.ErrInvalidExpression, token, expected)
+	}
+	p.pos++
+	p.depth--
+	return nil
+}
+
+// unexpectedEnd описывает выражение, оборвавшееся там, где ожидался операнд.
+func (p *parser) unexpectedEnd() error {
+	last := p.tokens[len(p.tokens)-1]
+	switch last.Kind {
+	case TokenOperator, TokenNegation:
+		return errorAt(errors.ErrExtraOperator, last, operandHint)
+	case TokenLeftParen:
+		return p.errorAtCursor(errors.ErrExtraOpenBracket, operandHint)
+	default:
+		return p.errorAtCursor(errors.ErrInvalidExpression, operandHint)
+	}
+}
+
+func arityHint(fn Function) string {
+	switch {
+	case fn.MaxArgs == Variadic:
+		return fmt.Sprintf("at least %s", arguments(fn.MinArgs))
+	case fn.MinArgs == fn.MaxArgs:
+		return arguments(fn.MinArgs)
+	default:
+		return fmt.Sprintf("%d to %s", fn.MinArgs, arguments(fn.MaxArgs))
+	}
+}
+
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
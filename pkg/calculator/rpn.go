@@ -3,46 +3,122 @@ package calculator
 import (
 	"github.com/InsafMin/web_calculator/pkg/errors"
 	"strconv"
+	"strings"
 )
 
 func ToRPN(tokens []string) ([]string, error) {
-	var output []string
-	var operators []string
-	skobaLevel := 0
+	classified, err := classify(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := ParseTokens(classified)
+	if err != nil {
+		return nil, err
+	}
+
+	return RPN(node)
+}
+
+// RPN записывает дерево выражения в обратной польской записи. Константы
+// заменяются числами, вызовы функций записываются через FunctionToken.
+func RPN(node Node) ([]string, error) {
+	switch n := node.(type) {
+	case *NumberNode:
+		return []string{n.Text}, nil
+	case *IdentNode:
+		value, err := n.Resolve(nil)
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.FormatFloat(value, 'g', -1, 64)}, nil
+	case OperationNode:
+		var output []string
+		for _, arg := range n.Args() {
+			rpn, err := RPN(arg)
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, rpn...)
+		}
+
+		if call, ok := n.(*CallNode); ok {
+			return append(output, FunctionToken(call.Name, len(call.Arguments))), nil
+		}
+		return append(output, n.Operation()), nil
+	default:
+		return nil, errors.ErrInvalidExpression
+	}
+}
+
+// Evaluate вычисляет выражение по лексемам в инфиксной записи, которые
+// возвращает Tokenize.
+func Evaluate(tokens []string) (float64, error) {
+	classified, err := classify(tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	node, err := ParseTokens(classified)
+	if err != nil {
+		return 0, err
+	}
+
+	return Eval(node, nil)
+}
+
+// EvaluateRPN вычисляет выражение, записанное в обратной польской записи,
+// например результат ToRPN.
+func EvaluateRPN(tokens []string) (float64, error) {
+	var numbers []float64
 
 	for _, token := range tokens {
-		if _, err := strconv.ParseFloat(token, 64); err == nil {
-			output = append(output, token)
-		} else if token == "(" {
-			skobaLevel += 2
-			operators = append(operators, token)
-		} else if token == ")" {
-			for len(operators) > 0 && operators[len(operators)-1] != "(" {
-				output = append(output, operators[len(operators)-1])
-				operators = operators[:len(operators)-1]
+		if num, err := strconv.ParseFloat(token, 64); err == nil {
+			numbers = append(numbers, num)
+			continue
+		}
+		if IsIdentifier(token) {
+			if name, argc, ok := ParseFunctionToken(token); ok {
+				if len(numbers) < argc {
+					return 0, errors.ErrInvalidExpression
+				}
+				res, err := CallFunction(name, numbers[len(numbers)-argc:])
+				if err != nil {
+					return 0, err
+				}
+				numbers = append(numbers[:len(numbers)-argc], res)
+				continue
 			}
-			if len(operators) == 0 {
-				return nil, errors.ErrInvalidExpression
+			if strings.Contains(token, ":") {
+				return 0, errors.ErrInvalidExpression
 			}
-			operators = operators[:len(operators)-1]
-			skobaLevel -= 2
-		} else if IsOperator(rune(token[0])) {
-			priority := Priority(token) + skobaLevel
-
-			for len(operators) > 0 && Priority(operators[len(operators)-1]) >= priority {
-				output = append(output, operators[len(operators)-1])
-				operators = operators[:len(operators)-1]
+
+			value, err := ResolveIdent(token, nil)
+			if err != nil {
+				return 0, err
 			}
-			operators = append(operators, token)
-		} else {
-			return nil, errors.ErrUnacceptableSymbol
+			numbers = append(numbers, value)
+			continue
+		}
+
+		argc := 2
+		if IsUnary(token) {
+			argc = 1
+		}
+		if len(numbers) < argc {
+			return 0, errors.ErrExtraOperator
+		}
+
+		res, err := Apply(token, numbers[len(numbers)-argc:])
+		if err != nil {
+			return 0, err
 		}
+		numbers = append(numbers[:len(numbers)-argc], res)
 	}
 
-	for len(operators) > 0 {
-		output = append(output, operators[len(operators)-1])
-		operators = operators[:len(operators)-1]
+	if len(numbers) != 1 {
+		return 0, errors.ErrInvalidExpression
 	}
 
-	return output, nil
+	return numbers[0], nil
 }
@@ -0,0 +1,38 @@
+package calculator
+
+import (
+	"github.com/InsafMin/web_calculator/pkg/errors"
+	"math"
+)
+
+var constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+func LookupConstant(name string) (float64, bool) {
+	value, exists := constants[name]
+	return value, exists
+}
+
+// ResolveIdent возвращает значение имени из выражения. Переменные запроса
+// имеют приоритет над встроенными константами.
+func ResolveIdent(name string, variables map[string]float64) (float64, error) {
+	if value, exists := variables[name]; exists {
+		return value, nil
+	}
+	if value, exists := LookupConstant(name); exists {
+		return value, nil
+	}
+	return 0, errors.ErrUndefinedVariable
+}
+
+// Resolve возвращает значение имени; для неизвестного имени ошибка указывает
+// на его место в выражении.
+func (n *IdentNode) Resolve(variables map[string]float64) (float64, error) {
+	value, err := ResolveIdent(n.Name, variables)
+	if err != nil {
+		return 0, &errors.ParseError{Err: err, Offset: n.Position, Token: n.Name}
+	}
+	return value, nil
+}
@@ -1,18 +1,108 @@
 package errors
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrDivisionByZero       = errors.New("division by zero")
-	ErrInvalidExpression    = errors.New("invalid expression")
-	ErrOperatorNotSupported = errors.New("operator not supported")
-	ErrUnacceptableSymbol   = errors.New("unacceptable symbol")
-	ErrExtraOperator        = errors.New("extra operator")
-	ErrExtraOpenBracket     = errors.New("extra open bracket")
-	ErrExtraCloseBracket    = errors.New("extra close bracket")
-	ErrNoTasksAvailable     = errors.New("no tasks available")
+	ErrDivisionByZero         = errors.New("division by zero")
+	ErrInvalidExpression      = errors.New("invalid expression")
+	ErrOperatorNotSupported   = errors.New("operator not supported")
+	ErrUnacceptableSymbol     = errors.New("unacceptable symbol")
+	ErrExtraOperator          = errors.New("extra operator")
+	ErrExtraOpenBracket       = errors.New("extra open bracket")
+	ErrExtraCloseBracket      = errors.New("extra close bracket")
+	ErrNoTasksAvailable       = errors.New("no tasks available")
+	ErrUnknownFunction        = errors.New("unknown function")
+	ErrWrongArgumentsCount    = errors.New("wrong number of function arguments")
+	ErrInvalidArgument        = errors.New("invalid function argument")
+	ErrUndefinedVariable      = errors.New("undefined variable")
+	ErrInvalidRequest         = errors.New("invalid request")
+	ErrExpressionNotFound     = errors.New("expression not found")
+	ErrTaskNotFound           = errors.New("task not found")
+	ErrMethodNotAllowed       = errors.New("method not allowed")
+	ErrLeaseExpired           = errors.New("task lease expired")
+	ErrAgentNotFound          = errors.New("agent not found")
+	ErrExpressionFinished     = errors.New("expression already finished")
+	ErrBatchNotFound          = errors.New("batch not found")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	ErrIdempotencyKeyReused   = errors.New("idempotency key reused with a different request")
+	ErrNonFiniteResult        = errors.New("result is not a finite number")
+	ErrRequestTooLarge        = errors.New("request body too large")
 )
 
+// codes — стабильные коды ошибок для клиентов API. Текст ошибок может
+// меняться, коды — нет.
+var codes = map[error]string{
+	ErrDivisionByZero:         "division_by_zero",
+	ErrInvalidExpression:      "invalid_expression",
+	ErrOperatorNotSupported:   "operator_not_supported",
+	ErrUnacceptableSymbol:     "unacceptable_symbol",
+	ErrExtraOperator:          "extra_operator",
+	ErrExtraOpenBracket:       "extra_open_bracket",
+	ErrExtraCloseBracket:      "extra_close_bracket",
+	ErrNoTasksAvailable:       "no_tasks_available",
+	ErrUnknownFunction:        "unknown_function",
+	ErrWrongArgumentsCount:    "wrong_arguments_count",
+	ErrInvalidArgument:        "invalid_argument",
+	ErrUndefinedVariable:      "undefined_variable",
+	ErrInvalidRequest:         "invalid_request",
+	ErrExpressionNotFound:     "expression_not_found",
+	ErrTaskNotFound:           "task_not_found",
+	ErrMethodNotAllowed:       "method_not_allowed",
+	ErrLeaseExpired:           "lease_expired",
+	ErrAgentNotFound:          "agent_not_found",
+	ErrExpressionFinished:     "expression_finished",
+	ErrBatchNotFound:          "batch_not_found",
+	ErrIdempotencyKeyNotFound: "idempotency_key_not_found",
+	ErrIdempotencyKeyReused:   "idempotency_key_reused",
+	ErrNonFiniteResult:        "non_finite_result",
+	ErrRequestTooLarge:        "request_too_large",
+}
+
+// Code возвращает стабильный код ошибки или "internal_error" для ошибок,
+// не описанных в этом пакете.
+func Code(err error) string {
+	for target, code := range codes {
+		if errors.Is(err, target) {
+			return code
+		}
+	}
+	return "internal_error"
+}
+
+// ParseError — ошибка разбора выражения с указанием места. Offset — смещение
+// в байтах от начала выражения, Token — лексема в этом месте (пустая, если
+// выражение оборвалось), Expected — подсказка, что ожидалось вместо неё.
+type ParseError struct {
+	Err      error
+	Offset   int
+	Token    string
+	Expected string
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+	if e.Token != "" {
+		msg += fmt.Sprintf(" near %q", e.Token)
+	} else {
+		msg += " at end of expression"
+	}
+	if e.Expected != "" {
+		msg += ", expected " + e.Expected
+	}
+	return msg
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 func Is(err, target error) bool {
 	return errors.Is(err, target)
 }
+
+func As(err error, target any) bool {
+	return errors.As(err, target)
+}